@@ -3,7 +3,9 @@ package bootstrap
 import (
 	"fmt"
 
+	"judge/challenge"
 	"judge/jConfig"
+	"judge/router/repository"
 	"judge/tester"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,20 +18,24 @@ func BuildApp() (*fiber.App, *zap.Logger, *jConfig.JudgeConfig) {
 	logger := bootstrapLogger(&config.Logger)
 
 	logger.Info("Starting Judge With Config,",
-		zap.String("config", fmt.Sprintf("%+v", config)),
+		zap.String("config", fmt.Sprintf("%+v", config.Redacted())),
 	)
 
 	db := bootstrapDatabase(logger, &config.Database)
 
 	bootstrapFolders(logger, &config)
 
-	dockerClient, err := bootstrapDocker(logger, &config)
+	sandbox, err := bootstrapSandbox(logger, &config)
 	if err != nil {
-		logger.Fatal("Failed to create Docker client", zap.Error(err))
+		logger.Fatal("Failed to create sandbox", zap.Error(err))
 	}
 
-	go tester.StartListener(logger, &config, db, dockerClient)
-	return bootstrapServer(logger, &config, db, dockerClient), logger, &config
+	// load the challenges before serving, then pick up edits of challenge authors
+	go challenge.GetCatalog(logger, &config.Challenge).Watch()
+	go tester.StartListener(logger, &config, db, sandbox)
+	go repository.WatchDeletedRepositories(logger, &config, db)
+	bootstrapSsh(logger, &config, db)
+	return bootstrapServer(logger, &config, db, sandbox), logger, &config
 }
 
 func Bootstrap() {
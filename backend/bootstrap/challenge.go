@@ -0,0 +1,95 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/tester"
+)
+
+const CHALLENGE_COMMAND_USAGE = `usage: judge challenge <command> <folder> [config.toml]
+
+commands:
+  lint    report every problem of attribute.toml and the files it refers to
+  verify  run the reference solution of every startpoint through every stage
+
+folder is the name of the challenge inside challenge.StorageFolder.`
+
+func challengeCommandConfig(args []string) jConfig.JudgeConfig {
+	if len(args) > 2 {
+		return jConfig.ParseJudgeConfig(args[2])
+	}
+	return jConfig.ParseJudgeConfig("config.toml")
+}
+
+func lintChallenge(config *jConfig.JudgeConfig, folderName string) int {
+	problems := challenge.Validate(&config.Challenge, folderName)
+	for _, problem := range problems {
+		fmt.Printf("%s/%s\n", folderName, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func verifyChallenge(config *jConfig.JudgeConfig, folderName string) int {
+	logger := bootstrapLogger(&config.Logger)
+	defer logger.Sync()
+	db := bootstrapDatabase(logger, &config.Database)
+
+	challengeRecord, err := challenge.ParseChallenge(logger, &config.Challenge, folderName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse challenge: %s\n", err)
+		return 1
+	}
+	sandbox, err := bootstrapSandbox(logger, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create sandbox: %s\n", err)
+		return 1
+	}
+	verifications, err := tester.VerifyChallenge(context.Background(), logger, config, db, sandbox, challengeRecord, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to verify challenge: %s\n", err)
+		return 1
+	}
+	if len(verifications) == 0 {
+		fmt.Fprintln(os.Stderr, "no startpoint has a reference solution")
+		return 1
+	}
+
+	code := 0
+	fmt.Println()
+	for _, verification := range verifications {
+		name := ""
+		if int(verification.Stage) < len(challengeRecord.Stages) {
+			name = challengeRecord.Stages[verification.Stage].Name
+		}
+		fmt.Printf("%-20s stage %-3d %-30s %s\n", verification.Startpoint, verification.Stage, name, verification.Status)
+		if verification.Status != tester.StatusSuccess {
+			code = 1
+		}
+	}
+	return code
+}
+
+// RunChallengeCommand runs `judge challenge`, args are those following it.
+// It returns the exit code.
+func RunChallengeCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, CHALLENGE_COMMAND_USAGE)
+		return 2
+	}
+	config := challengeCommandConfig(args)
+	switch args[0] {
+	case "lint":
+		return lintChallenge(&config, args[1])
+	case "verify":
+		return verifyChallenge(&config, args[1])
+	}
+	fmt.Fprintln(os.Stderr, CHALLENGE_COMMAND_USAGE)
+	return 2
+}
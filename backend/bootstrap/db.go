@@ -14,8 +14,15 @@ func bootstrapSchema(logger *zap.Logger, db *gorm.DB) {
 		&schema.User{},
 		&schema.UserAttribute{},
 		&schema.UserBasicAuthentication{},
+		&schema.UserPublicKey{},
+		&schema.UserAccessToken{},
 		&schema.Repository{},
+		&schema.RepositoryEvent{},
 		&schema.Testing{},
+		&schema.TestingStage{},
+		&schema.RepositoryStageScore{},
+		&schema.StartpointVerification{},
+		&schema.TestingCase{},
 		&schema.RepositoryTestingSerial{},
 	)
 	if err != nil {
@@ -9,7 +9,6 @@ import (
 	"judge/router/user"
 	"judge/tester"
 
-	"github.com/docker/docker/client"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -19,18 +18,27 @@ func bootstrapHandler(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
 	db *gorm.DB,
-	docker *client.Client,
+	sandbox tester.Sandbox,
 	app *fiber.App,
 ) {
 	queryRouter := app.Group("/query")
 	// POST /query graphql endpoint
 	query.SetupQueryRouter(logger, config, db, &queryRouter)
 	userRouter := app.Group("/user")
-	// /user requires Bearer oauth token and Provider in header
+	// /user requires Bearer oauth token and Provider in header, or Bearer personal access token with scope api
+	// changing the password, ssh keys or tokens needs the oauth token, access tokens are refused
 	// GET /user/info endpoint, returns user info
 	// GET /user/name endpoint, returns user git name
 	// POST /user/password update password
 	// query parameters: newPassword
+	// GET /user/keys list the ssh public keys of the user
+	// POST /user/keys add an ssh public key, body: {"name": "...", "key": "ssh-ed25519 AAAA... comment"}
+	// DELETE /user/keys remove an ssh public key
+	// query parameters: fingerprint
+	// GET /user/tokens list the personal access tokens of the user
+	// POST /user/tokens create a personal access token, the token is only returned here
+	// body: {"name": "...", "scopes": ["git:read", "git:write", "testing", "api"], "expiresInDays": 30}
+	// DELETE /user/tokens/{id} revoke a personal access token
 	user.SetupUserRouter(logger, config, db, &userRouter)
 	authRouter := app.Group("/auth")
 	// GET /auth/single-user endpoint, returns if single user mode is enabled
@@ -42,16 +50,32 @@ func bootstrapHandler(
 	// GET /auth/subject endpoint, returns subject from oauth2
 	auth.SetupAuthRouter(logger, config, &authRouter)
 	repoRouter := app.Group("/repo")
-	// /repo requires Bearer oauth token and Provider in header
+	// /repo requires Bearer oauth token and Provider in header, or Bearer personal access token with scope api
 	// POST /repo/project create a new repo
 	// query parameters: startpoint, folder
+	// PUT /repo/project/{repoId}/auto-test turn testing on push on or off
+	// query parameters: enabled
 	// ALL /repo/git/{provider}/{subject}/{challengeFolderName}/{repoId} git server
+	// basic auth with the git name and password, or any name and a personal access token with scope git:read or git:write
+	// pushes to archived repositories are refused, deleted repositories are not found
 	repository.SetupRepositoryRouter(logger, config, db, &repoRouter)
 	testingRouter := app.Group("/testing")
-	// /testing requires Bearer oauth token and Provider in header
+	// /testing requires Bearer oauth token and Provider in header, or Bearer personal access token with scope testing
 	// POST /testing/pending push a new testing request
-	// query repo, stage
-	tester.SetupTestingRouter(logger, config, db, docker, &testingRouter)
+	// query repo, stage, commit, regression
+	// GET /testing/:repo/:serial/stream follow the output of a testing as server sent events
+	// GET /testing/:repo/:serial/queue position in the queue, busy workers and estimated start time
+	// DELETE /testing/:repo/:serial cancel a pending or running testing
+	tester.SetupTestingRouter(logger, config, db, sandbox, &testingRouter)
+	workerRouter := app.Group("/worker")
+	// /worker requires Bearer testing.WorkerToken, job routes also X-Lease-Owner
+	// POST /worker/lease lease the next task, 204 if there is none
+	// GET /worker/:repo/:serial/source tested commit as tar.gz
+	// GET /worker/:repo/:serial/challenge test harness and stage mounts of the challenge as tar.gz
+	// POST /worker/:repo/:serial/heartbeat extend the lease, tells if the testing got cancelled
+	// POST /worker/:repo/:serial/log append output for live viewers
+	// POST /worker/:repo/:serial/result report the outcome and release the lease
+	tester.SetupWorkerRouter(logger, config, db, &workerRouter)
 	noteRouter := app.Group("/note")
 	// /note
 	// GET /note/:folderName/:stage/* Will return the note file, may be a markdown file or a webpage
@@ -0,0 +1,17 @@
+package bootstrap
+
+import (
+	"judge/jConfig"
+	"judge/tester"
+
+	"go.uber.org/zap"
+)
+
+func bootstrapSandbox(logger *zap.Logger, config *jConfig.JudgeConfig) (tester.Sandbox, error) {
+	sandbox, err := tester.NewSandbox(logger, config)
+	if err != nil {
+		logger.Error("Failed to create sandbox", zap.String("sandbox", config.Testing.Sandbox), zap.Error(err))
+		return nil, err
+	}
+	return sandbox, nil
+}
@@ -3,9 +3,9 @@ package bootstrap
 import (
 	"judge/jConfig"
 	"judge/middleware"
+	"judge/tester"
 	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -15,7 +15,7 @@ func bootstrapServer(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
 	db *gorm.DB,
-	docker *client.Client,
+	sandbox tester.Sandbox,
 ) *fiber.App {
 	app := fiber.New()
 
@@ -32,7 +32,7 @@ func bootstrapServer(
 		return err
 	})
 
-	bootstrapHandler(logger, config, db, docker, app)
+	bootstrapHandler(logger, config, db, sandbox, app)
 
 	app.Get("/ping", func(c *fiber.Ctx) error {
 		return c.SendString("pong")
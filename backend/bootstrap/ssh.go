@@ -0,0 +1,21 @@
+package bootstrap
+
+import (
+	"judge/jConfig"
+	"judge/router/repository"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func bootstrapSsh(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) {
+	if !config.Ssh.Enabled {
+		return
+	}
+	go func() {
+		// http keeps working without it, so this is not fatal
+		if err := repository.ServeSsh(logger, config, db); err != nil {
+			logger.Error("Failed to serve ssh", zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package bootstrap
+
+import (
+	"fmt"
+
+	"judge/jConfig"
+	"judge/tester"
+
+	"go.uber.org/zap"
+)
+
+// BootstrapWorker runs tasks of a remote server instead of serving, see [worker] of the config.
+func BootstrapWorker() {
+	config := jConfig.GetJudgeConfig()
+
+	logger := bootstrapLogger(&config.Logger)
+	defer logger.Sync()
+
+	logger.Info("Starting Judge Worker With Config,",
+		zap.String("config", fmt.Sprintf("%+v", config.Redacted())),
+	)
+
+	if config.Worker.ServerUrl == "" || config.Worker.Token == "" {
+		logger.Fatal("Worker requires worker.ServerUrl and worker.Token")
+	}
+
+	sandbox, err := bootstrapSandbox(logger, &config)
+	if err != nil {
+		logger.Fatal("Failed to create sandbox", zap.Error(err))
+	}
+
+	tester.StartWorker(logger, &config, sandbox)
+}
@@ -0,0 +1,240 @@
+package challenge
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"judge/jConfig"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DEFAULT_RELOAD_INTERVAL is used when ReloadIntervalInSecond of the challenge config is 0.
+const DEFAULT_RELOAD_INTERVAL = 2 * time.Second
+
+var ErrChallengeNotFound = errors.New("challenge not found")
+
+// catalogEntry is the state of one challenge folder.
+type catalogEntry struct {
+	// the last version that parsed, nil if none did
+	challenge *Challenge
+	// why the current version does not parse
+	err         error
+	problems    []Problem
+	fingerprint uint64
+}
+
+// catalogSnapshot is never changed once published, a reload publishes a new one.
+type catalogSnapshot struct {
+	folderNames []string
+	entries     map[string]*catalogEntry
+}
+
+// Catalog keeps the parsed challenges in memory and reloads those that changed on disk,
+// so requests do not parse attribute.toml and authors can edit challenges while the judge runs.
+type Catalog struct {
+	logger   *zap.Logger
+	config   *jConfig.ChallengeConfig
+	snapshot atomic.Pointer[catalogSnapshot]
+	// serializes reloads, readers only load the snapshot
+	reloading sync.Mutex
+}
+
+var catalog *Catalog = nil
+var catalogOnce sync.Once
+
+// GetCatalog returns the catalog of the judge, loading every challenge on the first call.
+func GetCatalog(logger *zap.Logger, config *jConfig.ChallengeConfig) *Catalog {
+	catalogOnce.Do(func() {
+		catalog = NewCatalog(logger, config)
+	})
+	return catalog
+}
+
+func NewCatalog(logger *zap.Logger, config *jConfig.ChallengeConfig) *Catalog {
+	c := &Catalog{logger: logger, config: config}
+	c.snapshot.Store(&catalogSnapshot{entries: make(map[string]*catalogEntry)})
+	c.Reload()
+	return c
+}
+
+// fingerprintFolder hashes the names, sizes and modification times of everything in a folder,
+// a change of any file of the challenge changes it.
+func fingerprintFolder(folderPath string) (uint64, error) {
+	hash := fnv.New64a()
+	err := filepath.WalkDir(folderPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(folderPath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%d\n", relativePath, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return hash.Sum64(), err
+}
+
+// Fingerprint identifies the current files of a challenge folder,
+// results computed from an older version of them carry another one.
+func Fingerprint(config *jConfig.ChallengeConfig, folderName string) (string, error) {
+	fingerprint, err := fingerprintFolder(filepath.Join(config.StorageFolder, folderName))
+	if err != nil {
+		return "", err
+	}
+	return formatFingerprint(fingerprint), nil
+}
+
+func formatFingerprint(fingerprint uint64) string {
+	return fmt.Sprintf("%016x", fingerprint)
+}
+
+// loadEntry parses a challenge folder, keeping the last version that parsed if it no longer does.
+func (c *Catalog) loadEntry(folderName string, previous *catalogEntry, fingerprint uint64) *catalogEntry {
+	entry := &catalogEntry{fingerprint: fingerprint}
+	challenge, err := ParseChallenge(c.logger, c.config, folderName)
+	entry.problems = Validate(c.config, folderName)
+	if err != nil {
+		entry.err = err
+		if previous != nil && previous.challenge != nil {
+			entry.challenge = previous.challenge
+			c.logger.Error("Keeping last version of broken challenge",
+				zap.String("folderName", folderName),
+				zap.Error(err),
+			)
+		}
+		return entry
+	}
+	entry.challenge = challenge
+	for _, problem := range entry.problems {
+		c.logger.Warn("Challenge has a problem",
+			zap.String("folderName", folderName),
+			zap.String("problem", problem.String()),
+		)
+	}
+	return entry
+}
+
+// Reload parses the challenges that changed since the last reload and publishes them at once.
+func (c *Catalog) Reload() {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	folderNames, err := listChallengeFolders(c.config)
+	if err != nil {
+		c.logger.Error("Failed to read challenge storage folder",
+			zap.String("path", c.config.StorageFolder),
+			zap.Error(err),
+		)
+		return
+	}
+	previous := c.snapshot.Load()
+	next := &catalogSnapshot{
+		folderNames: folderNames,
+		entries:     make(map[string]*catalogEntry, len(folderNames)),
+	}
+	changed := len(folderNames) != len(previous.folderNames)
+	for _, folderName := range folderNames {
+		previousEntry := previous.entries[folderName]
+		fingerprint, err := fingerprintFolder(filepath.Join(c.config.StorageFolder, folderName))
+		if err != nil {
+			// the folder may be half copied, try again on the next reload
+			c.logger.Warn("Failed to read challenge folder",
+				zap.String("folderName", folderName),
+				zap.Error(err),
+			)
+		}
+		if previousEntry != nil && (err != nil || previousEntry.fingerprint == fingerprint) {
+			next.entries[folderName] = previousEntry
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		changed = true
+		if previousEntry != nil {
+			c.logger.Info("Reloading challenge", zap.String("folderName", folderName))
+		}
+		next.entries[folderName] = c.loadEntry(folderName, previousEntry, fingerprint)
+	}
+	if !changed {
+		for _, folderName := range previous.folderNames {
+			if _, ok := next.entries[folderName]; !ok {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		c.snapshot.Store(next)
+	}
+}
+
+// Watch reloads the catalog periodically, it does not return unless
+// ReloadIntervalInSecond of the challenge config is negative.
+func (c *Catalog) Watch() {
+	if c.config.ReloadIntervalInSecond < 0 {
+		return
+	}
+	interval := time.Duration(c.config.ReloadIntervalInSecond) * time.Second
+	if interval == 0 {
+		interval = DEFAULT_RELOAD_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Reload()
+	}
+}
+
+// Get returns a copy of a challenge, the last version that parsed if it is broken now.
+func (c *Catalog) Get(folderName string) (*Challenge, error) {
+	entry, ok := c.snapshot.Load().entries[folderName]
+	if !ok {
+		return nil, ErrChallengeNotFound
+	}
+	if entry.challenge == nil {
+		return nil, entry.err
+	}
+	challenge := *entry.challenge
+	return &challenge, nil
+}
+
+// All returns the challenges that parsed, ordered by folder name.
+func (c *Catalog) All() []Challenge {
+	snapshot := c.snapshot.Load()
+	challenges := make([]Challenge, 0, len(snapshot.folderNames))
+	for _, folderName := range snapshot.folderNames {
+		if entry, ok := snapshot.entries[folderName]; ok && entry.challenge != nil {
+			challenges = append(challenges, *entry.challenge)
+		}
+	}
+	return challenges
+}
+
+// Fingerprint returns the fingerprint of the files the catalog last loaded for a challenge, see Fingerprint.
+func (c *Catalog) Fingerprint(folderName string) string {
+	entry, ok := c.snapshot.Load().entries[folderName]
+	if !ok {
+		return ""
+	}
+	return formatFingerprint(entry.fingerprint)
+}
+
+// Problems returns what Validate reported for the current version of a challenge.
+func (c *Catalog) Problems(folderName string) []Problem {
+	entry, ok := c.snapshot.Load().entries[folderName]
+	if !ok {
+		return []Problem{{File: ATTRIBUTE_FILE_NAME, Message: ErrChallengeNotFound.Error()}}
+	}
+	return entry.problems
+}
@@ -0,0 +1,47 @@
+package challenge
+
+import (
+	"judge/jConfig"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCatalogFingerprintFollowsChanges(t *testing.T) {
+	config := &jConfig.ChallengeConfig{StorageFolder: t.TempDir(), ReloadIntervalInSecond: -1}
+	attributePath := filepath.Join(config.StorageFolder, "hello", ATTRIBUTE_FILE_NAME)
+	if err := os.MkdirAll(filepath.Dir(attributePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(attributePath, []byte("Title = \"hello\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	catalog := NewCatalog(zap.NewNop(), config)
+	loaded := catalog.Fingerprint("hello")
+	verified, err := Fingerprint(config, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == "" || loaded != verified {
+		t.Fatalf("catalog fingerprint %q, folder fingerprint %q", loaded, verified)
+	}
+
+	// the modification time is part of the fingerprint, make sure it moves
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(attributePath, []byte("Title = \"hello again\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(attributePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	catalog.Reload()
+	if reloaded := catalog.Fingerprint("hello"); reloaded == verified {
+		t.Errorf("fingerprint %q unchanged after the challenge changed", reloaded)
+	}
+	if missing := catalog.Fingerprint("missing"); missing != "" {
+		t.Errorf("fingerprint of a missing challenge = %q", missing)
+	}
+}
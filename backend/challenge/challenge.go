@@ -12,11 +12,34 @@ import (
 
 const ATTRIBUTE_FILE_NAME = "attribute.toml"
 
+// DEFAULT_STAGE_MAX_SCORE is the score of stages without MaxScore,
+// so the total of such a challenge is the number of passed stages.
+const DEFAULT_STAGE_MAX_SCORE = 1
+
 type StartPoint struct {
 	Name        string
 	Description []string
 	Root        string
 	Dockerfile  string
+	// Files the dependencies are installed from, e.g. requirements.txt.
+	// A build reuses the cached image of an earlier one if these and the dockerfile are unchanged.
+	DependencyFiles []string
+	// Optional folder inside the challenge holding the graded tests.
+	// It is never copied into the student repository and is mounted read-only when testing.
+	TestHarness string
+	// Optional command replacing the CMD of the dockerfile when testing.
+	// Required with TestHarness, otherwise the student would decide what runs.
+	TestCommand []string
+	// Optional folder inside the challenge with the files solving every stage.
+	// They are copied over Root by `judge challenge verify`, and never given to students.
+	ReferenceSolution string
+}
+
+// StageMount mounts a file or folder of the challenge read-only into the test container.
+type StageMount struct {
+	// relative to the challenge folder
+	Source string
+	Target string
 }
 
 type Stage struct {
@@ -24,6 +47,17 @@ type Stage struct {
 	Description    []string
 	NoteFileOrPath string
 	NoteFileType   string
+	// overrides the limits of the challenge for this stage
+	Limits jConfig.ResourceLimitsConfig `toml:"limits"`
+	// overrides RunningTimeoutInMinute of the judge config, 0 keeps it
+	TimeoutInSecond int
+	// set in the test container in addition to STAGE
+	Env map[string]string `toml:"env"`
+	// replaces the TestCommand of the startpoint, or the CMD of the dockerfile
+	Command []string
+	Mounts  []StageMount `toml:"mounts"`
+	// points of the stage, see DEFAULT_STAGE_MAX_SCORE
+	MaxScore float64
 }
 
 type Basic struct {
@@ -38,6 +72,10 @@ type Challenge struct {
 	Basic       Basic        `toml:"basic"`
 	StartPoints []StartPoint `toml:"startpoints"`
 	Stages      []Stage      `toml:"stages"`
+	// overrides [testing.limits] of the judge config
+	Limits jConfig.ResourceLimitsConfig `toml:"limits"`
+	// test every earlier stage along with the requested one, unless the request says otherwise
+	Regression bool `toml:"regression"`
 }
 
 func ParseChallenge(logger *zap.Logger, config *jConfig.ChallengeConfig, folderName string) (*Challenge, error) {
@@ -52,23 +90,37 @@ func ParseChallenge(logger *zap.Logger, config *jConfig.ChallengeConfig, folderN
 		return nil, err
 	}
 	challenge.FolderName = folderName
+	for idx := range challenge.Stages {
+		if challenge.Stages[idx].MaxScore <= 0 {
+			challenge.Stages[idx].MaxScore = DEFAULT_STAGE_MAX_SCORE
+		}
+	}
 
 	return &challenge, nil
 }
 
-func ParseAllChallenges(logger *zap.Logger, config *jConfig.ChallengeConfig) ([]Challenge, error) {
+// MaxScore is the total of the max scores of all stages.
+func (c Challenge) MaxScore() float64 {
+	total := 0.0
+	for _, stage := range c.Stages {
+		total += stage.MaxScore
+	}
+	return total
+}
+
+// listChallengeFolders lists the folders of the storage folder that are not ignored.
+func listChallengeFolders(config *jConfig.ChallengeConfig) ([]string, error) {
 	entries, err := os.ReadDir(config.StorageFolder)
 	if err != nil {
-		logger.Error("Failed to read challenge storage folder",
-			zap.String("path", config.StorageFolder),
-			zap.Error(err),
-		)
 		return nil, err
 	}
 
 	ignorePatterns := make([]*regexp.Regexp, len(config.IgnorePatterns))
-	for i, pattern := range config.IgnorePatterns {
-		ignorePatterns[i] = regexp.MustCompile(pattern)
+	for idx, pattern := range config.IgnorePatterns {
+		ignorePatterns[idx], err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var folderNames []string
@@ -76,23 +128,48 @@ func ParseAllChallenges(logger *zap.Logger, config *jConfig.ChallengeConfig) ([]
 		if !entry.IsDir() {
 			continue
 		}
+		ignored := false
 		for _, pattern := range ignorePatterns {
 			if pattern.MatchString(entry.Name()) {
-				continue
+				ignored = true
 			}
 		}
-		folderNames = append(folderNames, entry.Name())
+		for _, glob := range config.IgnoreGlobs {
+			matched, err := filepath.Match(glob, entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				ignored = true
+			}
+		}
+		if !ignored {
+			folderNames = append(folderNames, entry.Name())
+		}
+	}
+	return folderNames, nil
+}
+
+func ParseAllChallenges(logger *zap.Logger, config *jConfig.ChallengeConfig) ([]Challenge, error) {
+	folderNames, err := listChallengeFolders(config)
+	if err != nil {
+		logger.Error("Failed to read challenge storage folder",
+			zap.String("path", config.StorageFolder),
+			zap.Error(err),
+		)
+		return nil, err
 	}
 
 	challenges := make([]Challenge, 0, len(folderNames))
 	for _, folderName := range folderNames {
 		challenge, err := ParseChallenge(logger, config, folderName)
 		if err != nil {
-			logger.Error("Failed to parse challenge",
+			// one broken challenge must not hide the others, see Validate
+			logger.Error("Skipping challenge that failed to parse",
 				zap.String("folderName", folderName),
 				zap.Error(err),
 			)
-			return nil, err
+			continue
 		}
 		challenges = append(challenges, *challenge)
 	}
@@ -0,0 +1,47 @@
+package challenge
+
+import (
+	"judge/jConfig"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListChallengeFolders(t *testing.T) {
+	tests := []struct {
+		name           string
+		ignorePatterns []string
+		ignoreGlobs    []string
+		want           []string
+	}{
+		{name: "nothing ignored", want: []string{".git", "_draft", "hello"}},
+		{name: "regular expressions", ignorePatterns: []string{`^\..*`, "^_"}, want: []string{"hello"}},
+		{name: "globs", ignoreGlobs: []string{".*", "_*"}, want: []string{"hello"}},
+		{name: "both", ignorePatterns: []string{`^\.`}, ignoreGlobs: []string{"_*"}, want: []string{"hello"}},
+	}
+	storageFolder := t.TempDir()
+	for _, folderName := range []string{".git", "_draft", "hello"} {
+		if err := os.Mkdir(filepath.Join(storageFolder, folderName), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(storageFolder, "README.md"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folderNames, err := listChallengeFolders(&jConfig.ChallengeConfig{
+				StorageFolder:  storageFolder,
+				IgnorePatterns: tt.ignorePatterns,
+				IgnoreGlobs:    tt.ignoreGlobs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(folderNames, tt.want) {
+				t.Errorf("folders = %v, want %v", folderNames, tt.want)
+			}
+		})
+	}
+}
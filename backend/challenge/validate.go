@@ -0,0 +1,315 @@
+package challenge
+
+import (
+	"errors"
+	"fmt"
+	"judge/jConfig"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	NOTE_FILE_TYPE_MARKDOWN = "markdown"
+	NOTE_FILE_TYPE_WEBSITE  = "website"
+)
+
+// Problem is something wrong with a challenge.
+// File is relative to the challenge folder, Line is 0 if the problem is not about a line.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+var arrayIndex = regexp.MustCompile(`\.\d+(\.|$)`)
+
+// keyLines maps the path of every key of a TOML document to its line,
+// elements of arrays of tables are numbered, e.g. stages.1.Name.
+// It only tokenizes as much as needed to find the keys, the document is parsed by toml.
+func keyLines(content string) map[string]int {
+	lines := make(map[string]int)
+	arrayLengths := make(map[string]int)
+	// resolves a table path, e.g. stages.env, to the current elements of its arrays, e.g. stages.1.env
+	resolve := func(table string) string {
+		parts := strings.Split(table, ".")
+		resolved := make([]string, 0, len(parts)*2)
+		for idx, part := range parts {
+			resolved = append(resolved, part)
+			prefix := strings.Join(parts[:idx+1], ".")
+			if length, ok := arrayLengths[prefix]; ok {
+				resolved = append(resolved, strconv.Itoa(length-1))
+			}
+		}
+		return strings.Join(resolved, ".")
+	}
+	normalizeKey := func(key string) string {
+		parts := strings.Split(key, ".")
+		for idx := range parts {
+			parts[idx] = strings.Trim(strings.TrimSpace(parts[idx]), `"'`)
+		}
+		return strings.Join(parts, ".")
+	}
+
+	table := ""
+	depth := 0
+	for number, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if depth == 0 && strings.HasPrefix(trimmed, "[[") {
+			name := normalizeKey(strings.TrimSuffix(strings.TrimPrefix(strings.SplitN(trimmed, "]]", 2)[0], "[["), "]]"))
+			// the array itself belongs to the enclosing table
+			parent := name[:max(strings.LastIndex(name, "."), 0)]
+			arrayName := name
+			if parent != "" {
+				arrayName = resolve(parent) + name[len(parent):]
+			}
+			arrayLengths[name]++
+			table = resolve(name)
+			if _, ok := lines[arrayName]; !ok {
+				lines[arrayName] = number + 1
+			}
+			lines[table] = number + 1
+			continue
+		}
+		if depth == 0 && strings.HasPrefix(trimmed, "[") {
+			table = resolve(normalizeKey(strings.SplitN(strings.TrimPrefix(trimmed, "["), "]", 2)[0]))
+			lines[table] = number + 1
+			continue
+		}
+		if depth == 0 {
+			if key, _, ok := strings.Cut(trimmed, "="); ok && !strings.HasPrefix(trimmed, "#") {
+				fullKey := normalizeKey(key)
+				if table != "" {
+					fullKey = table + "." + fullKey
+				}
+				lines[fullKey] = number + 1
+			}
+		}
+		// values may span lines, e.g. arrays, so track the brackets outside of strings and comments
+		var quote rune
+	scan:
+		for _, character := range line {
+			switch {
+			case quote != 0:
+				if character == quote {
+					quote = 0
+				}
+			case character == '"' || character == '\'':
+				quote = character
+			case character == '#':
+				break scan
+			case character == '[' || character == '{':
+				depth++
+			case character == ']' || character == '}':
+				depth--
+			}
+		}
+		if depth < 0 {
+			depth = 0
+		}
+	}
+	return lines
+}
+
+// validator collects the problems of one challenge.
+type validator struct {
+	challengePath string
+	lines         map[string]int
+	problems      []Problem
+}
+
+func (v *validator) report(key string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		File:    ATTRIBUTE_FILE_NAME,
+		Line:    v.lines[key],
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkExists reports a path of the challenge that escapes the folder or does not exist.
+func (v *validator) checkExists(key string, relativePath string) os.FileInfo {
+	if !filepath.IsLocal(relativePath) {
+		v.report(key, "%s is outside of the challenge folder", relativePath)
+		return nil
+	}
+	info, err := os.Stat(filepath.Join(v.challengePath, relativePath))
+	if err != nil {
+		v.report(key, "%s does not exist", relativePath)
+		return nil
+	}
+	return info
+}
+
+// checkPath is checkExists for paths that must be a folder, or must not be one.
+// It returns false if there was a problem.
+func (v *validator) checkPath(key string, relativePath string, wantDirectory bool) bool {
+	info := v.checkExists(key, relativePath)
+	if info == nil {
+		return false
+	}
+	if wantDirectory && !info.IsDir() {
+		v.report(key, "%s is not a folder", relativePath)
+		return false
+	}
+	if !wantDirectory && info.IsDir() {
+		v.report(key, "%s is a folder", relativePath)
+		return false
+	}
+	return true
+}
+
+func (v *validator) validateStartPoint(idx int, startpoint *StartPoint, names map[string]bool) {
+	key := fmt.Sprintf("startpoints.%d", idx)
+	if startpoint.Name == "" {
+		v.report(key, "startpoint has no Name")
+	} else if names[startpoint.Name] {
+		v.report(key+".Name", "startpoint %s is declared twice", startpoint.Name)
+	}
+	names[startpoint.Name] = true
+
+	if startpoint.Root == "" {
+		v.report(key, "startpoint %s has no Root", startpoint.Name)
+	} else if v.checkPath(key+".Root", startpoint.Root, true) {
+		if startpoint.Dockerfile == "" {
+			v.report(key, "startpoint %s has no Dockerfile", startpoint.Name)
+		} else {
+			v.checkPath(key+".Dockerfile", filepath.Join(startpoint.Root, startpoint.Dockerfile), false)
+		}
+		for _, dependencyFile := range startpoint.DependencyFiles {
+			v.checkPath(key+".DependencyFiles", filepath.Join(startpoint.Root, dependencyFile), false)
+		}
+	}
+	if startpoint.TestHarness != "" {
+		v.checkPath(key+".TestHarness", startpoint.TestHarness, true)
+		// without it the CMD of the student dockerfile runs, and could write the report itself
+		if len(startpoint.TestCommand) == 0 {
+			v.report(key+".TestHarness", "startpoint %s has a TestHarness but no TestCommand", startpoint.Name)
+		}
+	}
+	if startpoint.ReferenceSolution != "" {
+		v.checkPath(key+".ReferenceSolution", startpoint.ReferenceSolution, true)
+	}
+}
+
+func (v *validator) validateStage(idx int, stage *Stage) {
+	key := fmt.Sprintf("stages.%d", idx)
+	if stage.Name == "" {
+		v.report(key, "stage %d has no Name", idx)
+	}
+	var index string
+	switch stage.NoteFileType {
+	case NOTE_FILE_TYPE_MARKDOWN:
+		index = "index.md"
+	case NOTE_FILE_TYPE_WEBSITE:
+		index = "index.html"
+	default:
+		v.report(key+".NoteFileType", "NoteFileType must be %s or %s, not %q",
+			NOTE_FILE_TYPE_MARKDOWN, NOTE_FILE_TYPE_WEBSITE, stage.NoteFileType)
+	}
+	if stage.NoteFileOrPath == "" {
+		v.report(key, "stage %d has no NoteFileOrPath", idx)
+	} else if v.checkPath(key+".NoteFileOrPath", stage.NoteFileOrPath, true) && index != "" {
+		v.checkPath(key+".NoteFileOrPath", filepath.Join(stage.NoteFileOrPath, index), false)
+	}
+	if stage.TimeoutInSecond < 0 {
+		v.report(key+".TimeoutInSecond", "TimeoutInSecond must not be negative")
+	}
+	if stage.MaxScore < 0 {
+		v.report(key+".MaxScore", "MaxScore must not be negative")
+	}
+	for _, stageMount := range stage.Mounts {
+		v.checkExists(key+".Mounts", stageMount.Source)
+		if !path.IsAbs(stageMount.Target) {
+			v.report(key+".Mounts", "mount target %q is not an absolute path", stageMount.Target)
+		}
+	}
+}
+
+// Validate reports every problem of a challenge, such as unknown keys and missing files,
+// that would otherwise only show when a student uses it.
+func Validate(config *jConfig.ChallengeConfig, folderName string) []Problem {
+	v := &validator{challengePath: filepath.Join(config.StorageFolder, folderName)}
+	content, err := os.ReadFile(filepath.Join(v.challengePath, ATTRIBUTE_FILE_NAME))
+	if err != nil {
+		v.report("", "%s", err)
+		return v.problems
+	}
+	var challenge Challenge
+	metaData, err := toml.Decode(string(content), &challenge)
+	if err != nil {
+		var parseError toml.ParseError
+		if errors.As(err, &parseError) {
+			// drop the "toml: line N" prefix, the line is reported on its own
+			_, message, _ := strings.Cut(parseError.Error(), ": line ")
+			_, message, _ = strings.Cut(message, ": ")
+			v.problems = append(v.problems, Problem{
+				File:    ATTRIBUTE_FILE_NAME,
+				Line:    parseError.Position.Line,
+				Message: message,
+			})
+		} else {
+			v.report("", "%s", err)
+		}
+		return v.problems
+	}
+	v.lines = keyLines(string(content))
+
+	// keys of arrays of tables come without the index, once per element,
+	// so report every line they are on once
+	reported := make(map[string]bool)
+	for _, key := range metaData.Undecoded() {
+		if reported[key.String()] {
+			continue
+		}
+		reported[key.String()] = true
+		found := false
+		for path, line := range v.lines {
+			if arrayIndex.ReplaceAllString(path, "$1") == key.String() {
+				v.problems = append(v.problems, Problem{
+					File:    ATTRIBUTE_FILE_NAME,
+					Line:    line,
+					Message: fmt.Sprintf("unknown key %s", key),
+				})
+				found = true
+			}
+		}
+		if !found {
+			v.report("", "unknown key %s", key)
+		}
+	}
+
+	if challenge.Basic.Title == "" {
+		v.report("basic", "basic.Title is missing")
+	}
+	if len(challenge.StartPoints) == 0 {
+		v.report("", "the challenge has no startpoints")
+	}
+	names := make(map[string]bool)
+	for idx := range challenge.StartPoints {
+		v.validateStartPoint(idx, &challenge.StartPoints[idx], names)
+	}
+	if len(challenge.Stages) == 0 {
+		v.report("", "the challenge has no stages")
+	}
+	for idx := range challenge.Stages {
+		v.validateStage(idx, &challenge.Stages[idx])
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
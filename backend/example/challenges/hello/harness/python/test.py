@@ -0,0 +1,14 @@
+import os
+import subprocess
+
+report_dir = os.environ.get("REPORT_DIR", "/mnt/report")
+
+# runs from the working directory of the image, which holds the student's code
+output = subprocess.run(["python", "a.py"], capture_output=True, text=True).stdout
+passed = output.strip() == "EXAMPLE"
+
+with open(os.path.join(report_dir, "message.md"), "w") as f:
+    f.write("Hello World!" if passed else "Expected a.py to print EXAMPLE, got:\n\n" + output)
+
+with open(os.path.join(report_dir, "result"), "w") as f:
+    f.write("t" if passed else "f")
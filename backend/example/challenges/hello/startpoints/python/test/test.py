@@ -1,7 +0,0 @@
-import os
-
-with open("/mnt/report/message.md", "w") as f:
-    f.write("Hello World!")
-    
-with open("/mnt/report/result", "w") as f:
-    f.write("t")
\ No newline at end of file
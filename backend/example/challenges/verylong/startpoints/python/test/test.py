@@ -1,7 +1,15 @@
+import json
 import os
 
-with open("/mnt/report/message.md", "w") as f:
-    f.write("Hello World!")
-    
-with open("/mnt/report/result", "w") as f:
-    f.write("t")
\ No newline at end of file
+report_dir = os.environ.get("REPORT_DIR", "/mnt/report")
+
+# a structured report, the stage passes if no case failed
+report = {
+    "message": "Hello World!",
+    "cases": [
+        {"name": "test_hello", "status": "passed", "duration": 0.01},
+    ],
+}
+
+with open(os.path.join(report_dir, "report.json"), "w") as f:
+    json.dump(report, f)
@@ -17,6 +17,8 @@ type LoggerConfig struct {
 
 type RepositoryStorageConfig struct {
 	StorageFolder string
+	// how long a deleted repository can be restored, 0 means 30 days
+	DeleteGracePeriodInDay int
 }
 
 type DatabaseConfig struct {
@@ -29,9 +31,14 @@ type ServerConfig struct {
 }
 
 type ChallengeConfig struct {
-	StorageFolder          string
-	IgnorePatterns         []string
+	StorageFolder string
+	// regular expressions of folder names that are not challenges, e.g. ^\. for hidden folders
+	IgnorePatterns []string
+	// the same as globs, e.g. .* for hidden folders
+	IgnoreGlobs            []string
 	MarkdownStyleSheetPath string
+	// how often changed challenges are reloaded, 0 means every 2 seconds, negative never
+	ReloadIntervalInSecond int
 }
 
 type AuthenticationServerConfig struct {
@@ -51,13 +58,94 @@ type AuthenticationConfig struct {
 	AuthenticationTimeoutInSecond int
 }
 
+// ResourceLimitsConfig limits a test container.
+// It is used by [testing.limits] and may be overridden per challenge and per stage,
+// zero values inherit the less specific setting.
+type ResourceLimitsConfig struct {
+	MemoryInMegabytes int64
+	// number of CPUs, e.g. 0.5
+	Cpus      float64
+	PidsLimit int64
+	// size of the tmpfs mounted at /tmp
+	TmpfsSizeInMegabytes int64
+	// only supported by some storage drivers, e.g. overlay2 on xfs with pquota
+	DiskSizeInMegabytes int64
+	// docker network mode, defaults to none
+	NetworkMode      string
+	ReadOnlyRootfs   *bool
+	DropCapabilities []string
+}
+
+// Override returns l with every field set in o replaced.
+func (l ResourceLimitsConfig) Override(o ResourceLimitsConfig) ResourceLimitsConfig {
+	if o.MemoryInMegabytes != 0 {
+		l.MemoryInMegabytes = o.MemoryInMegabytes
+	}
+	if o.Cpus != 0 {
+		l.Cpus = o.Cpus
+	}
+	if o.PidsLimit != 0 {
+		l.PidsLimit = o.PidsLimit
+	}
+	if o.TmpfsSizeInMegabytes != 0 {
+		l.TmpfsSizeInMegabytes = o.TmpfsSizeInMegabytes
+	}
+	if o.DiskSizeInMegabytes != 0 {
+		l.DiskSizeInMegabytes = o.DiskSizeInMegabytes
+	}
+	if o.NetworkMode != "" {
+		l.NetworkMode = o.NetworkMode
+	}
+	if o.ReadOnlyRootfs != nil {
+		l.ReadOnlyRootfs = o.ReadOnlyRootfs
+	}
+	if o.DropCapabilities != nil {
+		l.DropCapabilities = o.DropCapabilities
+	}
+	return l
+}
+
+// ImageCacheConfig keeps built images around so their layers are reused by later builds.
+// Images are evicted least recently used first once either budget is exceeded, 0 means no budget.
+type ImageCacheConfig struct {
+	Enabled            bool
+	MaxImages          int
+	MaxSizeInMegabytes int64
+}
+
 type TestingConfig struct {
 	PendingQueueSize            int
 	PendingQueueTimeoutInMinute int
 	MaxConcurrentWorkers        int
+	MaxRunningTasksPerUser      int
+	MaxPendingTasksPerUser      int
 	RunningTimeoutInMinute      int
+	LeaseTimeoutInSecond        int
+	PollIntervalInSecond        int
+	RequeueOrphanedTasks        bool
+	Sandbox                     string
 	DockerSocket                string
+	PodmanSocket                string
 	TmpStorageFolder            string
+	WorkerToken                 string
+	Limits                      ResourceLimitsConfig `toml:"limits"`
+	ImageCache                  ImageCacheConfig     `toml:"cache"`
+}
+
+// WorkerConfig is used by `judge worker`, which runs tasks leased from the server at ServerUrl.
+// The worker takes its sandbox, concurrency, limits and cache from [testing].
+type WorkerConfig struct {
+	ServerUrl string
+	Token     string
+}
+
+// SshConfig serves the repositories to git over ssh, users authenticate with the keys added at /user/keys.
+type SshConfig struct {
+	Enabled  bool
+	HostPort int
+	HostAddr string
+	// private key of the server, an ed25519 key is generated if it does not exist
+	HostKeyPath string
 }
 
 type JudgeConfig struct {
@@ -68,8 +156,35 @@ type JudgeConfig struct {
 	Logger            LoggerConfig            `toml:"logger"`
 	Authentication    AuthenticationConfig    `toml:"auth"`
 	Testing           TestingConfig           `toml:"testing"`
+	Worker            WorkerConfig            `toml:"worker"`
+	Ssh               SshConfig               `toml:"ssh"`
 }
 
+const REDACTED = "[redacted]"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return REDACTED
+}
+
+// Redacted is a copy of the config without the tokens and client secrets, for logging it.
+func (c JudgeConfig) Redacted() JudgeConfig {
+	servers := make([]AuthenticationServerConfig, 0, len(c.Authentication.AuthenticationServers))
+	for _, server := range c.Authentication.AuthenticationServers {
+		server.ClientSecret = redact(server.ClientSecret)
+		servers = append(servers, server)
+	}
+	c.Authentication.AuthenticationServers = servers
+	c.Testing.WorkerToken = redact(c.Testing.WorkerToken)
+	c.Worker.Token = redact(c.Worker.Token)
+	return c
+}
+
+const WORKER_COMMAND = "worker"
+const CHALLENGE_COMMAND = "challenge"
+
 func ParseJudgeConfig(path string) JudgeConfig {
 	var config JudgeConfig
 	if _, err := toml.DecodeFile(path, &config); err != nil {
@@ -80,6 +195,10 @@ func ParseJudgeConfig(path string) JudgeConfig {
 
 func GetJudgeConfig() JudgeConfig {
 	args := os.Args
+	// skip the subcommand, e.g. judge worker config.toml
+	if len(args) > 1 && args[1] == WORKER_COMMAND {
+		args = args[1:]
+	}
 	var configFile string
 	if len(args) > 1 {
 		configFile = args[1]
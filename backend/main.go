@@ -2,8 +2,19 @@ package main
 
 import (
 	"judge/bootstrap"
+	"judge/jConfig"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case jConfig.WORKER_COMMAND:
+			bootstrap.BootstrapWorker()
+			return
+		case jConfig.CHALLENGE_COMMAND:
+			os.Exit(bootstrap.RunChallengeCommand(os.Args[2:]))
+		}
+	}
 	bootstrap.Bootstrap()
 }
@@ -8,6 +8,7 @@ import (
 	"judge/router"
 	"judge/schema"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -126,7 +127,31 @@ const PROVIDER_LOCAL_KEY = "provider"
 const SINGLE_USER_PROVIDER = "localhost"
 const SINGLE_USER_SUBJECT = "subject"
 
+// accessTokenError answers a request whose personal access token was refused.
+func accessTokenError(c *fiber.Ctx, err error, scope string) error {
+	switch {
+	case errors.Is(err, ErrInvalidAccessToken):
+		return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError("Invalid access token"))
+	case errors.Is(err, ErrExpiredAccessToken):
+		return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError("Access token expired"))
+	case errors.Is(err, ErrMissingScope):
+		return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access token lacks the scope " + scope))
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to check access token"))
+}
+
 func BuildAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return BuildScopedAuthorizationMiddleWare(logger, config, db, TOKEN_SCOPE_API)
+}
+
+// BuildScopedAuthorizationMiddleWare also accepts a personal access token with the scope as Bearer token,
+// oauth tokens are not scoped.
+func BuildScopedAuthorizationMiddleWare(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	scope string,
+) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		if config.Authentication.SingleUser {
 			c.Locals(SUBJECT_LOCAL_KEY, SINGLE_USER_SUBJECT)
@@ -139,6 +164,18 @@ func BuildAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeConfi
 			return c.Next()
 		}
 
+		if accessToken, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer "); ok && IsAccessToken(accessToken) {
+			tokenRecord, err := authenticateAccessToken(logger, db, accessToken, scope)
+			if err != nil {
+				return accessTokenError(c, err, scope)
+			}
+			c.Locals(SUBJECT_LOCAL_KEY, tokenRecord.Subject)
+			c.Locals(PROVIDER_LOCAL_KEY, tokenRecord.Provider)
+			c.Locals(USER_INFO_LOCAL_KEY, "{}")
+			c.Locals(ACCESS_TOKEN_LOCAL_KEY, tokenRecord)
+			return c.Next()
+		}
+
 		provider := c.Get("Provider")
 
 		if provider == "" {
@@ -180,3 +217,15 @@ func BuildAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeConfi
 		return c.Next()
 	}
 }
+
+// BuildOptionalAuthorizationMiddleWare authorizes the request only if it carries credentials.
+// Handlers behind it must check the locals themselves before doing anything on behalf of a user.
+func BuildOptionalAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	authorization := BuildAuthorizationMiddleWare(logger, config, db)
+	return func(c *fiber.Ctx) error {
+		if config.Authentication.SingleUser || c.Get("Authorization") != "" {
+			return authorization(c)
+		}
+		return c.Next()
+	}
+}
@@ -14,6 +14,9 @@ import (
 	"gorm.io/gorm"
 )
 
+// RECEIVE_PACK_SERVICE is the git service of pushes, the others only read.
+const RECEIVE_PACK_SERVICE = "git-receive-pack"
+
 func BuildGitAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		if config.Authentication.SingleUser {
@@ -48,6 +51,24 @@ func BuildGitAuthorizationMiddleWare(logger *zap.Logger, config *jConfig.JudgeCo
 		if !ok {
 			return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError("Failed to decode basic token"))
 		}
+		// with a personal access token as password the username does not matter, like on other git hosts
+		if IsAccessToken(password) {
+			scope := TOKEN_SCOPE_GIT_READ
+			if strings.HasSuffix(c.Path(), "/"+RECEIVE_PACK_SERVICE) || c.Query("service") == RECEIVE_PACK_SERVICE {
+				scope = TOKEN_SCOPE_GIT_WRITE
+			}
+			tokenRecord, err := authenticateAccessToken(logger, db, password, scope)
+			if err != nil {
+				return accessTokenError(c, err, scope)
+			}
+			if tokenRecord.Subject != subject || tokenRecord.Provider != provider {
+				return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError("Mismatched username or provider"))
+			}
+			c.Locals(SUBJECT_LOCAL_KEY, subject)
+			c.Locals(PROVIDER_LOCAL_KEY, provider)
+			c.Locals(ACCESS_TOKEN_LOCAL_KEY, tokenRecord)
+			return c.Next()
+		}
 		decodedProvider, decodedSubject := shared.DecodeUserGitName(logger, username)
 		logger.Debug(
 			"Decoded username and provider",
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"judge/schema"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ACCESS_TOKEN_PREFIX tells personal access tokens apart from oauth tokens and git passwords.
+const ACCESS_TOKEN_PREFIX = "judge_"
+const ACCESS_TOKEN_LOCAL_KEY = "accessToken"
+
+const (
+	TOKEN_SCOPE_GIT_READ  = "git:read"
+	TOKEN_SCOPE_GIT_WRITE = "git:write"
+	TOKEN_SCOPE_TESTING   = "testing"
+	TOKEN_SCOPE_API       = "api"
+)
+
+var TOKEN_SCOPES = []string{TOKEN_SCOPE_GIT_READ, TOKEN_SCOPE_GIT_WRITE, TOKEN_SCOPE_TESTING, TOKEN_SCOPE_API}
+
+var ErrInvalidAccessToken = errors.New("invalid access token")
+var ErrExpiredAccessToken = errors.New("access token expired")
+var ErrMissingScope = errors.New("access token lacks the scope")
+
+// HashAccessToken is what is stored of a token, tokens are random enough not to need a slow hash.
+func HashAccessToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateAccessToken returns a new token, which is only ever shown to the user once.
+func GenerateAccessToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return ACCESS_TOKEN_PREFIX + base58.Encode(secret), nil
+}
+
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, ACCESS_TOKEN_PREFIX)
+}
+
+// TokenScopes splits the scopes stored with a token.
+func TokenScopes(tokenRecord *schema.UserAccessToken) []string {
+	if tokenRecord.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(tokenRecord.Scopes, ",")
+}
+
+func hasScope(tokenRecord *schema.UserAccessToken, scope string) bool {
+	for _, tokenScope := range TokenScopes(tokenRecord) {
+		// pushing needs the repository anyway, so write includes read
+		if tokenScope == scope || (scope == TOKEN_SCOPE_GIT_READ && tokenScope == TOKEN_SCOPE_GIT_WRITE) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAccessToken finds the token and checks it is valid for the scope, recording its use.
+func authenticateAccessToken(
+	logger *zap.Logger,
+	db *gorm.DB,
+	token string,
+	scope string,
+) (*schema.UserAccessToken, error) {
+	var tokenRecord schema.UserAccessToken
+	found := db.Where("token_hash = ?", HashAccessToken(token)).Limit(1).Find(&tokenRecord)
+	if found.Error != nil {
+		logger.Error("Failed to look up access token", zap.Error(found.Error))
+		return nil, found.Error
+	}
+	if found.RowsAffected == 0 {
+		return nil, ErrInvalidAccessToken
+	}
+	now := time.Now()
+	if tokenRecord.ExpireTime != "" {
+		expireTime, err := time.Parse(time.RFC3339, tokenRecord.ExpireTime)
+		if err != nil || now.After(expireTime) {
+			return nil, ErrExpiredAccessToken
+		}
+	}
+	if !hasScope(&tokenRecord, scope) {
+		return nil, ErrMissingScope
+	}
+	tokenRecord.LastUsedTime = now.Format(time.RFC3339)
+	err := db.Model(&schema.UserAccessToken{}).Where("id = ?", tokenRecord.Id).
+		Update("last_used_time", tokenRecord.LastUsedTime).Error
+	if err != nil {
+		// the request is still authorized
+		logger.Error("Failed to record access token use", zap.Error(err))
+	}
+	return &tokenRecord, nil
+}
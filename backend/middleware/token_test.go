@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"errors"
+	"judge/schema"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		scope  string
+		want   bool
+	}{
+		{name: "no scopes", scopes: "", scope: TOKEN_SCOPE_API, want: false},
+		{name: "exact scope", scopes: TOKEN_SCOPE_API, scope: TOKEN_SCOPE_API, want: true},
+		{name: "one of several", scopes: "testing,api", scope: TOKEN_SCOPE_TESTING, want: true},
+		{name: "other scope", scopes: TOKEN_SCOPE_TESTING, scope: TOKEN_SCOPE_API, want: false},
+		{name: "write includes read", scopes: TOKEN_SCOPE_GIT_WRITE, scope: TOKEN_SCOPE_GIT_READ, want: true},
+		{name: "read does not include write", scopes: TOKEN_SCOPE_GIT_READ, scope: TOKEN_SCOPE_GIT_WRITE, want: false},
+		{name: "api does not include git", scopes: TOKEN_SCOPE_API, scope: TOKEN_SCOPE_GIT_READ, want: false},
+		{name: "no prefix match", scopes: "git", scope: TOKEN_SCOPE_GIT_READ, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenRecord := &schema.UserAccessToken{Scopes: tt.scopes}
+			if got := hasScope(tokenRecord, tt.scope); got != tt.want {
+				t.Errorf("hasScope(%q, %q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAccessToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		scopes     string
+		expireTime string
+		token      string
+		scope      string
+		wantErr    error
+	}{
+		{name: "valid", scopes: TOKEN_SCOPE_API, token: "judge_valid", scope: TOKEN_SCOPE_API},
+		{name: "never used token", scopes: TOKEN_SCOPE_API, token: "judge_other", scope: TOKEN_SCOPE_API, wantErr: ErrInvalidAccessToken},
+		{name: "missing scope", scopes: TOKEN_SCOPE_GIT_READ, token: "judge_valid", scope: TOKEN_SCOPE_API, wantErr: ErrMissingScope},
+		{
+			name:       "expired",
+			scopes:     TOKEN_SCOPE_API,
+			expireTime: time.Now().Add(-time.Hour).Format(time.RFC3339),
+			token:      "judge_valid",
+			scope:      TOKEN_SCOPE_API,
+			wantErr:    ErrExpiredAccessToken,
+		},
+		{
+			name:       "not expired yet",
+			scopes:     TOKEN_SCOPE_API,
+			expireTime: time.Now().Add(time.Hour).Format(time.RFC3339),
+			token:      "judge_valid",
+			scope:      TOKEN_SCOPE_API,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "judge.db")), &gorm.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AutoMigrate(&schema.UserAccessToken{}); err != nil {
+				t.Fatal(err)
+			}
+			db.Create(&schema.UserAccessToken{
+				Id:         "id",
+				Subject:    "subject",
+				Provider:   "provider",
+				TokenHash:  HashAccessToken("judge_valid"),
+				Scopes:     tt.scopes,
+				ExpireTime: tt.expireTime,
+			})
+
+			tokenRecord, err := authenticateAccessToken(zap.NewNop(), db, tt.token, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			var saved schema.UserAccessToken
+			db.Where("id = ?", "id").First(&saved)
+			if tt.wantErr != nil {
+				if saved.LastUsedTime != "" {
+					t.Errorf("recorded the use of a refused token")
+				}
+				return
+			}
+			if tokenRecord.Subject != "subject" || saved.LastUsedTime == "" {
+				t.Errorf("token of %q, last used %q", tokenRecord.Subject, saved.LastUsedTime)
+			}
+		})
+	}
+}
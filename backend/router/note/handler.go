@@ -14,8 +14,8 @@ import (
 )
 
 const (
-	NOTE_FILE_TYPE_MARKDOWN = "markdown"
-	NOTE_FILE_TYPE_WEBSITE  = "website"
+	NOTE_FILE_TYPE_MARKDOWN = challenge.NOTE_FILE_TYPE_MARKDOWN
+	NOTE_FILE_TYPE_WEBSITE  = challenge.NOTE_FILE_TYPE_WEBSITE
 )
 
 func ServeWebSite(
@@ -122,11 +122,7 @@ func BuildNoteHandler(
 			))
 		}
 
-		challengeRecord, err := challenge.ParseChallenge(
-			logger,
-			&config.Challenge,
-			folderName,
-		)
+		challengeRecord, err := challenge.GetCatalog(logger, &config.Challenge).Get(folderName)
 
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
@@ -2,12 +2,107 @@ package query
 
 import (
 	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/tester"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
-func (this *r) Challenges() ([]challenge.Challenge, error) {
-	return challenge.ParseAllChallenges(this.logger, &this.config.Challenge)
+// ChallengeResponse adds the problems of the challenge, and the results of `judge challenge verify`
+// to the startpoints.
+type ChallengeResponse struct {
+	challenge.Challenge
+	logger *zap.Logger
+	config *jConfig.JudgeConfig
+	db     *gorm.DB
+}
+
+type StartPointResponse struct {
+	challenge.StartPoint
+	verifications []schema.StartpointVerification
+}
+
+// VerificationResponse is nil for startpoints whose reference solution was never run,
+// or not since the challenge last changed.
+type VerificationResponse struct {
+	Passed     bool
+	VerifyTime string
+	Stages     []schema.StartpointVerification
+}
+
+func (c *ChallengeResponse) StartPoints() ([]*StartPointResponse, error) {
+	// results of an older version of the challenge no longer tell anything
+	fingerprint := challenge.GetCatalog(c.logger, &c.config.Challenge).Fingerprint(c.FolderName)
+	var verifications []schema.StartpointVerification
+	err := c.db.Where("challenge_folder_name = ? AND fingerprint = ?", c.FolderName, fingerprint).
+		Order("stage").Find(&verifications).Error
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]*StartPointResponse, 0, len(c.Challenge.StartPoints))
+	for _, startpoint := range c.Challenge.StartPoints {
+		response := &StartPointResponse{StartPoint: startpoint}
+		for _, verification := range verifications {
+			if verification.Startpoint == startpoint.Name {
+				response.verifications = append(response.verifications, verification)
+			}
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// Problems are formatted like file:line: message, see challenge.Validate.
+func (c *ChallengeResponse) Problems() []string {
+	problems := challenge.GetCatalog(c.logger, &c.config.Challenge).Problems(c.FolderName)
+	responses := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		responses = append(responses, problem.String())
+	}
+	return responses
+}
+
+// Broken challenges cannot be started, see BuildNewRepositoryHandler.
+func (c *ChallengeResponse) Broken() bool {
+	return len(c.Problems()) > 0
+}
+
+func (s *StartPointResponse) Verification() *VerificationResponse {
+	if len(s.verifications) == 0 {
+		return nil
+	}
+	response := &VerificationResponse{
+		Passed:     true,
+		VerifyTime: s.verifications[0].VerifyTime,
+		Stages:     s.verifications,
+	}
+	for _, verification := range s.verifications {
+		if verification.Status != tester.StatusSuccess {
+			response.Passed = false
+		}
+	}
+	return response
+}
+
+func (this *r) wrapChallenge(challengeRecord challenge.Challenge) *ChallengeResponse {
+	return &ChallengeResponse{Challenge: challengeRecord, logger: this.logger, config: this.config, db: this.db}
+}
+
+func (this *r) Challenges() ([]*ChallengeResponse, error) {
+	challenges := challenge.GetCatalog(this.logger, &this.config.Challenge).All()
+	responses := make([]*ChallengeResponse, 0, len(challenges))
+	for _, challengeRecord := range challenges {
+		responses = append(responses, this.wrapChallenge(challengeRecord))
+	}
+	return responses, nil
 }
 
-func (this *r) Challenge(args struct{ FolderName string }) (*challenge.Challenge, error) {
-	return challenge.ParseChallenge(this.logger, &this.config.Challenge, args.FolderName)
+func (this *r) Challenge(args struct{ FolderName string }) (*ChallengeResponse, error) {
+	challengeRecord, err := challenge.GetCatalog(this.logger, &this.config.Challenge).Get(args.FolderName)
+	if err != nil {
+		return nil, err
+	}
+	return this.wrapChallenge(*challengeRecord), nil
 }
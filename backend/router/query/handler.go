@@ -1,7 +1,10 @@
 package query
 
 import (
+	"context"
+	"errors"
 	"judge/jConfig"
+	"judge/middleware"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
@@ -16,6 +19,20 @@ func getSchema() string {
 	type StartPoint {
 		name: String!
 		description: [String!]!
+		# null unless the reference solution ran since the challenge last changed
+		verification: Verification
+	}
+
+	type Verification {
+		passed: Boolean!
+		verifyTime: String!
+		stages: [VerificationStage!]!
+	}
+
+	type VerificationStage {
+		stage: Int!
+		status: String!
+		message: String!
 	}
 	
 	type Stage {
@@ -23,6 +40,7 @@ func getSchema() string {
 		description: [String!]!
 		noteFileOrPath: String!
 		noteFileType: String!
+		maxScore: Float!
 	}
 
 	type Challenge {
@@ -30,6 +48,9 @@ func getSchema() string {
 		startPoints: [StartPoint!]!
 		stages: [Stage!]!
 		basic: Basic!
+		maxScore: Float!
+		problems: [String!]!
+		broken: Boolean!
 	}
 	
 	type Basic {
@@ -56,12 +77,44 @@ func getSchema() string {
 		repositoryId: String!
 		serial: Int!
 		stage: Int!
+		commit: String!
+		regression: Boolean!
 		status: String!
 		message: String!
 		log: String!
+		buildLog: String!
 		createTime: String!
 		runStartTime: String!
 		runEndTime: String!
+		stages: [TestingStage!]!
+		cases: [TestingCase!]!
+		queuePosition: Int
+		estimatedStartTime: String
+	}
+
+	type TestingQueue {
+		pending: Int!
+		busyWorkers: Int!
+		totalWorkers: Int!
+		averageRunDurationInSecond: Int!
+	}
+
+	type TestingStage {
+		stage: Int!
+		status: String!
+		message: String!
+		score: Float!
+		maxScore: Float!
+	}
+
+	type TestingCase {
+		position: Int!
+		stage: Int!
+		name: String!
+		className: String!
+		status: String!
+		durationInMillisecond: Int!
+		output: String!
 	}
 	
 	type Repository {
@@ -72,23 +125,137 @@ func getSchema() string {
 		startpoint: String!
 		stage: Int!
 		totalStages: Int!
+		autoTest: Boolean!
 		createTime: String!
 		updateTime: String!
+		# empty unless archived, archived repositories refuse pushes and testings
+		archiveTime: String!
+		# empty unless deleted, deleted repositories can be restored until purgeTime
+		deleteTime: String!
+		purgeTime: String!
+		scores: [StageScore!]!
+		score: Float!
+		maxScore: Float!
+		# commits, tree, blob and diff are only shown to the owner
+		# newest first, ref defaults to HEAD, after is the endCursor of the previous page
+		commits(first: Int, after: String, ref: String): CommitConnection!
+		# null if path is not a folder, path defaults to the root
+		tree(ref: String, path: String): [TreeEntry!]
+		# null if path is not a file
+		blob(ref: String, path: String!): Blob
+		# to defaults to HEAD
+		diff(from: String!, to: String): [FileDiff!]!
+		# oldest first
+		events: [RepositoryEvent!]!
+	}
+
+	type RepositoryEvent {
+		serial: Int!
+		# reset, switchStartpoint, archive, delete or restore
+		action: String!
+		subject: String!
+		provider: String!
+		fromStartpoint: String!
+		toStartpoint: String!
+		fromStage: Int!
+		toStage: Int!
+		fromCommit: String!
+		toCommit: String!
+		keepHistory: Boolean!
+		createTime: String!
+	}
+
+	type CommitConnection {
+		nodes: [Commit!]!
+		endCursor: String
+		hasNextPage: Boolean!
+	}
+
+	type Commit {
+		hash: String!
+		message: String!
+		authorName: String!
+		authorEmail: String!
+		authorTime: String!
+		committerTime: String!
+		parents: [String!]!
+		testings: [Testing!]!
+	}
+
+	type TreeEntry {
+		name: String!
+		path: String!
+		# blob, tree or submodule
+		type: String!
+		mode: String!
+		hash: String!
+		size: Int!
+	}
+
+	type Blob {
+		path: String!
+		hash: String!
+		size: Int!
+		binary: Boolean!
+		# null for binary files and files over 1 MiB
+		content: String
+	}
+
+	type FileDiff {
+		fromPath: String!
+		toPath: String!
+		binary: Boolean!
+		additions: Int!
+		deletions: Int!
+		patch: String!
+	}
+
+	type StageScore {
+		stage: Int!
+		score: Float!
+		maxScore: Float!
+		serial: Int
 	}
 	
 	type Query {
 		challenge(folderName: String!): Challenge
 		challenges: [Challenge!]!
-		repositories(subject: String!, provider: String!): [Repository!]!
+		repositories(subject: String!, provider: String!, includeArchived: Boolean = false, includeDeleted: Boolean = false): [Repository!]!
 		repository(repositoryId: String!): Repository
 		user(subject: String!, provider: String!): User
 		testingsByRepository(repositoryId: String!): [Testing!]!
 		testing(repositoryId: String!, serial: Int!): Testing
 		testingsByStage(repositoryId: String!, stage: Int!): [Testing!]!
+		testingQueue: TestingQueue!
+	}
+
+	type Mutation {
+		pushToPending(repositoryId: String!, stage: Int, commit: String, regression: Boolean): Testing
+		cancelTesting(repositoryId: String!, serial: Int!): Testing
+		setAutoTest(repositoryId: String!, enabled: Boolean!): Repository
+		# back to the startpoint at stage 0, without keepHistory the repository only has the initial commit
+		resetRepository(repositoryId: String!, keepHistory: Boolean = true): Repository
+		switchStartpoint(repositoryId: String!, startpoint: String!, keepHistory: Boolean = true): Repository
+		archiveRepository(repositoryId: String!): Repository
+		deleteRepository(repositoryId: String!): Repository
+		# undoes archiveRepository and deleteRepository
+		restoreRepository(repositoryId: String!): Repository
 	}
 	`
 }
 
+var errUnauthorized = errors.New("unauthorized")
+
+// identityFromContext reads the user set by the optional authorization middleware.
+func identityFromContext(ctx context.Context) (string, string, error) {
+	provider, _ := ctx.Value(middleware.PROVIDER_LOCAL_KEY).(string)
+	subject, _ := ctx.Value(middleware.SUBJECT_LOCAL_KEY).(string)
+	if provider == "" || subject == "" {
+		return "", "", errUnauthorized
+	}
+	return provider, subject, nil
+}
+
 type r struct {
 	logger *zap.Logger
 	config *jConfig.JudgeConfig
@@ -108,5 +275,10 @@ func SetupQueryRouter(
 		db:     db,
 	}, graphql.UseFieldResolvers())
 	handler := &relay.Handler{Schema: schema}
-	(*group).Post("/", adaptor.HTTPHandlerFunc(handler.ServeHTTP))
+	// mutations act on behalf of the user, queries stay public
+	(*group).Post(
+		"/",
+		middleware.BuildOptionalAuthorizationMiddleWare(logger, config, db),
+		adaptor.HTTPHandlerFunc(handler.ServeHTTP),
+	)
 }
@@ -0,0 +1,155 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"judge/schema"
+	"judge/shared"
+	"judge/tester"
+)
+
+const DEFAULT_COMMIT_PAGE_SIZE = 20
+const MAX_COMMIT_PAGE_SIZE = 100
+
+// CommitResponse links a commit to the testings of it.
+type CommitResponse struct {
+	shared.Commit
+	testings []*TestingResponse
+}
+
+func (c *CommitResponse) Testings() []*TestingResponse {
+	return c.testings
+}
+
+// CommitConnectionResponse is a page of commits, EndCursor is the after of the next page.
+type CommitConnectionResponse struct {
+	Nodes       []*CommitResponse
+	EndCursor   *string
+	HasNextPage bool
+}
+
+func optionalString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// checkOwner refuses to show the code of a repository to anyone but its owner.
+func (t *RepositoryResponse) checkOwner(ctx context.Context) error {
+	resolver := &r{logger: t.logger, config: t.config, db: t.db}
+	_, err := resolver.ownedRepository(ctx, t.RepositoryId)
+	return err
+}
+
+func (t *RepositoryResponse) Commits(ctx context.Context, args struct {
+	First *int32
+	After *string
+	Ref   *string
+}) (*CommitConnectionResponse, error) {
+	if err := t.checkOwner(ctx); err != nil {
+		return nil, err
+	}
+	first := DEFAULT_COMMIT_PAGE_SIZE
+	if args.First != nil {
+		first = min(max(int(*args.First), 0), MAX_COMMIT_PAGE_SIZE)
+	}
+	commits, hasNextPage, err := shared.ListCommits(
+		tester.GetRepositoryPath(t.config, &t.Repository),
+		optionalString(args.Ref),
+		optionalString(args.After),
+		first,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(commits))
+	for _, commit := range commits {
+		hashes = append(hashes, commit.Hash)
+	}
+	var testings []schema.Testing
+	if len(hashes) > 0 {
+		err := t.db.Where("repository_id = ? AND `commit` IN ?", t.RepositoryId, hashes).
+			Order("serial").Find(&testings).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	testingsByCommit := make(map[string][]*TestingResponse)
+	for _, testing := range testings {
+		testingsByCommit[testing.Commit] = append(testingsByCommit[testing.Commit],
+			&TestingResponse{Testing: testing, config: t.config, db: t.db})
+	}
+
+	response := &CommitConnectionResponse{
+		Nodes:       make([]*CommitResponse, 0, len(commits)),
+		HasNextPage: hasNextPage,
+	}
+	for _, commit := range commits {
+		testings := testingsByCommit[commit.Hash]
+		if testings == nil {
+			testings = []*TestingResponse{}
+		}
+		response.Nodes = append(response.Nodes, &CommitResponse{Commit: commit, testings: testings})
+	}
+	if len(commits) > 0 {
+		response.EndCursor = &commits[len(commits)-1].Hash
+	}
+	return response, nil
+}
+
+// Tree is nil if path is not a folder of the commit.
+func (t *RepositoryResponse) Tree(ctx context.Context, args struct {
+	Ref  *string
+	Path *string
+}) (*[]shared.TreeEntry, error) {
+	if err := t.checkOwner(ctx); err != nil {
+		return nil, err
+	}
+	entries, err := shared.ListTree(
+		tester.GetRepositoryPath(t.config, &t.Repository),
+		optionalString(args.Ref),
+		optionalString(args.Path),
+	)
+	if errors.Is(err, shared.ErrPathNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// Blob is nil if path is not a file of the commit.
+func (t *RepositoryResponse) Blob(ctx context.Context, args struct {
+	Ref  *string
+	Path string
+}) (*shared.Blob, error) {
+	if err := t.checkOwner(ctx); err != nil {
+		return nil, err
+	}
+	blob, err := shared.ReadBlob(
+		tester.GetRepositoryPath(t.config, &t.Repository),
+		optionalString(args.Ref),
+		args.Path,
+	)
+	if errors.Is(err, shared.ErrPathNotFound) {
+		return nil, nil
+	}
+	return blob, err
+}
+
+func (t *RepositoryResponse) Diff(ctx context.Context, args struct {
+	From string
+	To   *string
+}) ([]shared.FileDiff, error) {
+	if err := t.checkOwner(ctx); err != nil {
+		return nil, err
+	}
+	return shared.DiffCommits(
+		tester.GetRepositoryPath(t.config, &t.Repository),
+		args.From,
+		optionalString(args.To),
+	)
+}
@@ -0,0 +1,41 @@
+package query
+
+import (
+	"context"
+	"judge/router/repository"
+	"judge/schema"
+
+	"gorm.io/gorm"
+)
+
+func (t *RepositoryResponse) PurgeTime() string {
+	return repository.PurgeTime(t.config, &t.Repository)
+}
+
+// updateOwnedRepository runs one of the lifecycle changes of the repository package on a repository of the user.
+func (this *r) updateOwnedRepository(
+	ctx context.Context,
+	repositoryId string,
+	update func(db *gorm.DB, repositoryRecord *schema.Repository, provider string, subject string) error,
+) (*RepositoryResponse, error) {
+	repositoryRecord, err := this.ownedRepository(ctx, repositoryId)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(this.db, repositoryRecord, repositoryRecord.Provider, repositoryRecord.Subject); err != nil {
+		return nil, err
+	}
+	return this.wrapRepository(*repositoryRecord), nil
+}
+
+func (this *r) ArchiveRepository(ctx context.Context, args struct{ RepositoryId string }) (*RepositoryResponse, error) {
+	return this.updateOwnedRepository(ctx, args.RepositoryId, repository.ArchiveRepository)
+}
+
+func (this *r) DeleteRepository(ctx context.Context, args struct{ RepositoryId string }) (*RepositoryResponse, error) {
+	return this.updateOwnedRepository(ctx, args.RepositoryId, repository.DeleteRepository)
+}
+
+func (this *r) RestoreRepository(ctx context.Context, args struct{ RepositoryId string }) (*RepositoryResponse, error) {
+	return this.updateOwnedRepository(ctx, args.RepositoryId, repository.RestoreRepository)
+}
@@ -1,18 +1,139 @@
 package query
 
-import "judge/schema"
+import (
+	"context"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// RepositoryResponse adds the scores of Repository, which need the challenge.
+type RepositoryResponse struct {
+	schema.Repository
+	logger *zap.Logger
+	config *jConfig.JudgeConfig
+	db     *gorm.DB
+}
+
+// StageScoreResponse is the best score of a stage, Serial is nil if the stage scored nothing yet.
+type StageScoreResponse struct {
+	Stage    int32
+	Score    float64
+	MaxScore float64
+	Serial   *int32
+}
+
+func (this *r) wrapRepository(repository schema.Repository) *RepositoryResponse {
+	return &RepositoryResponse{Repository: repository, logger: this.logger, config: this.config, db: this.db}
+}
+
+func (t *RepositoryResponse) Scores() ([]*StageScoreResponse, error) {
+	challengeRecord, err := challenge.GetCatalog(t.logger, &t.config.Challenge).Get(t.ChallengeFolderName)
+	if err != nil {
+		return nil, err
+	}
+	var best []schema.RepositoryStageScore
+	if err := t.db.Where("repository_id = ?", t.RepositoryId).Find(&best).Error; err != nil {
+		return nil, err
+	}
+	bestByStage := make(map[int32]schema.RepositoryStageScore, len(best))
+	for _, score := range best {
+		bestByStage[score.Stage] = score
+	}
+	responses := make([]*StageScoreResponse, 0, len(challengeRecord.Stages))
+	for idx, stage := range challengeRecord.Stages {
+		response := &StageScoreResponse{Stage: int32(idx), MaxScore: stage.MaxScore}
+		if score, ok := bestByStage[int32(idx)]; ok {
+			response.Score = score.Score
+			response.Serial = &score.Serial
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+func (t *RepositoryResponse) Score() (float64, error) {
+	scores, err := t.Scores()
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, score := range scores {
+		total += score.Score
+	}
+	return total, nil
+}
+
+func (t *RepositoryResponse) MaxScore() (float64, error) {
+	challengeRecord, err := challenge.GetCatalog(t.logger, &t.config.Challenge).Get(t.ChallengeFolderName)
+	if err != nil {
+		return 0, err
+	}
+	return challengeRecord.MaxScore(), nil
+}
 
 func (this *r) Repositories(args struct {
-	Subject  string
-	Provider string
-}) ([]schema.Repository, error) {
-	responses := make([]schema.Repository, 0)
-	this.db.Where("subject = ? AND provider = ?", args.Subject, args.Provider).Find(&responses)
+	Subject         string
+	Provider        string
+	IncludeArchived bool
+	IncludeDeleted  bool
+}) ([]*RepositoryResponse, error) {
+	repositories := make([]schema.Repository, 0)
+	query := this.db.Where("subject = ? AND provider = ?", args.Subject, args.Provider)
+	if !args.IncludeArchived {
+		query = query.Where("archive_time = '' OR archive_time IS NULL")
+	}
+	if !args.IncludeDeleted {
+		query = query.Where("delete_time = '' OR delete_time IS NULL")
+	}
+	query.Find(&repositories)
+	responses := make([]*RepositoryResponse, 0, len(repositories))
+	for _, repository := range repositories {
+		responses = append(responses, this.wrapRepository(repository))
+	}
 	return responses, nil
 }
 
-func (this *r) Repository(args struct{ RepositoryId string }) (*schema.Repository, error) {
+func (this *r) Repository(args struct{ RepositoryId string }) (*RepositoryResponse, error) {
 	response := new(schema.Repository)
 	this.db.Where("repository_id = ?", args.RepositoryId).First(response)
+	return this.wrapRepository(*response), nil
+}
+
+// ownedRepository loads a repository and checks it belongs to the user of the request.
+func (this *r) ownedRepository(ctx context.Context, repositoryId string) (*schema.Repository, error) {
+	provider, subject, err := identityFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := new(schema.Repository)
+	if err := this.db.Where("repository_id = ?", repositoryId).First(response).Error; err != nil {
+		return nil, err
+	}
+	if response.Provider != provider || response.Subject != subject {
+		return nil, errUnauthorized
+	}
 	return response, nil
 }
+
+func (this *r) SetAutoTest(ctx context.Context, args struct {
+	RepositoryId string
+	Enabled      bool
+}) (*RepositoryResponse, error) {
+	response, err := this.ownedRepository(ctx, args.RepositoryId)
+	if err != nil {
+		return nil, err
+	}
+	err = this.db.Model(response).Updates(map[string]interface{}{
+		"auto_test":   args.Enabled,
+		"update_time": time.Now().Format(time.RFC3339),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return this.wrapRepository(*response), nil
+}
@@ -0,0 +1,80 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"judge/challenge"
+	"judge/router/repository"
+	"judge/schema"
+)
+
+var errStartpointNotFound = errors.New("startpoint not found")
+var errSameStartpoint = errors.New("repository is already on this startpoint")
+var errBrokenChallenge = errors.New("challenge has problems, try again once they are fixed")
+
+func (t *RepositoryResponse) Events() ([]schema.RepositoryEvent, error) {
+	events := make([]schema.RepositoryEvent, 0)
+	err := t.db.Where("repository_id = ?", t.RepositoryId).Order("serial").Find(&events).Error
+	return events, err
+}
+
+// findStartPoint looks a startpoint of the challenge of a repository up, refusing broken challenges.
+func (this *r) findStartPoint(repositoryRecord *schema.Repository, name string) (*challenge.StartPoint, error) {
+	catalog := challenge.GetCatalog(this.logger, &this.config.Challenge)
+	challengeRecord, err := catalog.Get(repositoryRecord.ChallengeFolderName)
+	if err != nil {
+		return nil, err
+	}
+	if len(catalog.Problems(repositoryRecord.ChallengeFolderName)) > 0 {
+		return nil, errBrokenChallenge
+	}
+	startpoint := challengeRecord.FindStartPoint(name)
+	if startpoint == nil {
+		return nil, errStartpointNotFound
+	}
+	return startpoint, nil
+}
+
+func (this *r) ResetRepository(ctx context.Context, args struct {
+	RepositoryId string
+	KeepHistory  bool
+}) (*RepositoryResponse, error) {
+	repositoryRecord, err := this.ownedRepository(ctx, args.RepositoryId)
+	if err != nil {
+		return nil, err
+	}
+	startpoint, err := this.findStartPoint(repositoryRecord, repositoryRecord.Startpoint)
+	if err != nil {
+		return nil, err
+	}
+	err = repository.ResetRepository(this.logger, this.config, this.db, repositoryRecord, startpoint,
+		args.KeepHistory, repositoryRecord.Provider, repositoryRecord.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return this.wrapRepository(*repositoryRecord), nil
+}
+
+func (this *r) SwitchStartpoint(ctx context.Context, args struct {
+	RepositoryId string
+	Startpoint   string
+	KeepHistory  bool
+}) (*RepositoryResponse, error) {
+	repositoryRecord, err := this.ownedRepository(ctx, args.RepositoryId)
+	if err != nil {
+		return nil, err
+	}
+	if args.Startpoint == repositoryRecord.Startpoint {
+		return nil, errSameStartpoint
+	}
+	startpoint, err := this.findStartPoint(repositoryRecord, args.Startpoint)
+	if err != nil {
+		return nil, err
+	}
+	err = repository.SwitchStartpoint(this.logger, this.config, this.db, repositoryRecord, startpoint,
+		args.KeepHistory, repositoryRecord.Provider, repositoryRecord.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return this.wrapRepository(*repositoryRecord), nil
+}
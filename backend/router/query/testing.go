@@ -1,33 +1,148 @@
 package query
 
-import "judge/schema"
+import (
+	"context"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/tester"
+	"sync"
 
-func (this *r) TestingsByRepository(args struct{ RepositoryId string }) ([]schema.Testing, error) {
+	"gorm.io/gorm"
+)
+
+// TestingResponse adds the fields of Testing that need another lookup.
+type TestingResponse struct {
+	schema.Testing
+	config *jConfig.JudgeConfig
+	db     *gorm.DB
+	// the queue is simulated once for all the fields that need it, see queueStatus
+	queueStatusOnce sync.Once
+	queueStatus     *tester.QueueStatus
+	queueStatusErr  error
+}
+
+func (this *r) wrapTestings(testings []schema.Testing) []*TestingResponse {
+	responses := make([]*TestingResponse, 0, len(testings))
+	for _, testing := range testings {
+		responses = append(responses, &TestingResponse{Testing: testing, config: this.config, db: this.db})
+	}
+	return responses
+}
+
+func (t *TestingResponse) Cases() ([]schema.TestingCase, error) {
+	cases := make([]schema.TestingCase, 0)
+	err := t.db.Where("repository_id = ? AND serial = ?", t.RepositoryId, t.Serial).Order("position").Find(&cases).Error
+	if err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
+
+func (t *TestingResponse) Stages() ([]schema.TestingStage, error) {
+	stages := make([]schema.TestingStage, 0)
+	err := t.db.Where("repository_id = ? AND serial = ?", t.RepositoryId, t.Serial).Order("stage").Find(&stages).Error
+	if err != nil {
+		return nil, err
+	}
+	return stages, nil
+}
+
+// getQueueStatus is nil unless the testing is pending.
+func (t *TestingResponse) getQueueStatus() (*tester.QueueStatus, error) {
+	if t.Status != tester.StatusPending {
+		return nil, nil
+	}
+	t.queueStatusOnce.Do(func() {
+		t.queueStatus, t.queueStatusErr = tester.GetQueueStatus(t.config, t.db, &t.Testing)
+	})
+	return t.queueStatus, t.queueStatusErr
+}
+
+func (t *TestingResponse) QueuePosition() (*int32, error) {
+	status, err := t.getQueueStatus()
+	if status == nil || err != nil {
+		return nil, err
+	}
+	return status.Position, nil
+}
+
+func (t *TestingResponse) EstimatedStartTime() (*string, error) {
+	status, err := t.getQueueStatus()
+	if status == nil || err != nil {
+		return nil, err
+	}
+	return status.EstimatedStartTime, nil
+}
+
+func (this *r) TestingQueue() (*tester.QueueStatus, error) {
+	return tester.GetQueueStatus(this.config, this.db, &schema.Testing{})
+}
+
+func (this *r) TestingsByRepository(args struct{ RepositoryId string }) ([]*TestingResponse, error) {
 	var r []schema.Testing
 	if err := this.db.Where("repository_id = ?", args.RepositoryId).Find(&r).Error; err != nil {
 		return nil, err
 	}
-	return r, nil
+	return this.wrapTestings(r), nil
 }
 
 func (this *r) TestingsByStage(args struct {
 	RepositoryId string
 	Stage        int32
-}) ([]schema.Testing, error) {
+}) ([]*TestingResponse, error) {
 	var r []schema.Testing
 	if err := this.db.Where("repository_id = ? AND stage = ?", args.RepositoryId, args.Stage).Find(&r).Error; err != nil {
 		return nil, err
 	}
-	return r, nil
+	return this.wrapTestings(r), nil
 }
 
 func (this *r) Testing(args struct {
 	RepositoryId string
 	Serial       int32
-}) (*schema.Testing, error) {
+}) (*TestingResponse, error) {
 	var r schema.Testing
 	if err := this.db.Where("repository_id = ? AND serial = ?", args.RepositoryId, args.Serial).First(&r).Error; err != nil {
 		return nil, err
 	}
-	return &r, nil
+	return &TestingResponse{Testing: r, config: this.config, db: this.db}, nil
+}
+
+func (this *r) PushToPending(ctx context.Context, args struct {
+	RepositoryId string
+	Stage        *int32
+	Commit       *string
+	Regression   *bool
+}) (*TestingResponse, error) {
+	repositoryRecord, err := this.ownedRepository(ctx, args.RepositoryId)
+	if err != nil {
+		return nil, err
+	}
+	stage := repositoryRecord.Stage
+	if args.Stage != nil {
+		stage = *args.Stage
+	}
+	commit := ""
+	if args.Commit != nil {
+		commit = *args.Commit
+	}
+	r, err := tester.PushToPending(this.logger, this.config, this.db, args.RepositoryId, int(stage), commit, args.Regression)
+	if err != nil {
+		return nil, err
+	}
+	return &TestingResponse{Testing: *r, config: this.config, db: this.db}, nil
+}
+
+func (this *r) CancelTesting(ctx context.Context, args struct {
+	RepositoryId string
+	Serial       int32
+}) (*TestingResponse, error) {
+	if _, err := this.ownedRepository(ctx, args.RepositoryId); err != nil {
+		return nil, err
+	}
+	r, err := tester.CancelTesting(this.logger, this.db, args.RepositoryId, args.Serial)
+	if err != nil {
+		return nil, err
+	}
+	return &TestingResponse{Testing: *r, config: this.config, db: this.db}, nil
 }
@@ -2,12 +2,12 @@ package repository
 
 import (
 	"fmt"
-	"io"
 	"judge/challenge"
 	"judge/jConfig"
 	"judge/middleware"
 	"judge/router"
 	"judge/schema"
+	"judge/shared"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -38,50 +38,13 @@ func generateFlakeId() string {
 	return encoded
 }
 
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
+// botSignature signs the commits the judge makes in student repositories.
+func botSignature() *object.Signature {
+	return &object.Signature{
+		Name:  "gardener-bot",
+		Email: "gardener-bot@greenhouse.com",
+		When:  time.Now(),
 	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return err
-	}
-
-	stat, err := srcFile.Stat()
-	if err != nil {
-		return err
-	}
-	return dstFile.Chmod(stat.Mode())
-}
-
-func copyDir(src string, dst string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
-			return err
-		}
-
-		dstPath := filepath.Join(dst, relPath)
-
-		if info.IsDir() {
-			return os.MkdirAll(dstPath, info.Mode())
-		}
-
-		return copyFile(path, dstPath)
-	})
 }
 
 func createRepositoryFiles(logger *zap.Logger, judgeConfig *jConfig.JudgeConfig, provider, subject, folderName string, startpoint *challenge.StartPoint, repoId string) error {
@@ -103,7 +66,7 @@ func createRepositoryFiles(logger *zap.Logger, judgeConfig *jConfig.JudgeConfig,
 		return err
 	}
 	// copy all the files from startpointRootPath to repositoryPath
-	if err := copyDir(startpointRootPath, repositoryPath); err != nil {
+	if err := shared.CopyDir(startpointRootPath, repositoryPath); err != nil {
 		logger.Error("Failed to copy files from startpoint root to repository",
 			zap.String("startpoint", startpoint.Name),
 			zap.String("startpointRootPath", startpointRootPath),
@@ -143,11 +106,7 @@ func createRepositoryFiles(logger *zap.Logger, judgeConfig *jConfig.JudgeConfig,
 
 	// commit the changes
 	commit, err := worktree.Commit("Initial commit", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "gardener-bot",
-			Email: "gardener-bot@greenhouse.com",
-			When:  time.Now(),
-		},
+		Author: botSignature(),
 	})
 	if err != nil {
 		logger.Error("Failed to commit changes",
@@ -185,21 +144,6 @@ func createRepositoryFiles(logger *zap.Logger, judgeConfig *jConfig.JudgeConfig,
 		return err
 	}
 
-	// add a hook to the repository
-	hookPath := filepath.Join(repositoryPath, ".git", "hooks", "post-commit")
-	hookContent := fmt.Sprintf(`
-	# !/bin/sh
-	# This hook is used to initiate a test after a commit is made
-	curl -X POST %s:%d/testing/pending?repo=%s
-	`, judgeConfig.Server.HostAddr, judgeConfig.Server.HostPort, repoId)
-	if err := os.WriteFile(hookPath, []byte(hookContent), 0755); err != nil {
-		logger.Error("Failed to write hook file",
-			zap.String("hookPath", hookPath),
-			zap.Error(err),
-		)
-		return err
-	}
-
 	logger.Info("Repository initialized and initial commit created",
 		zap.String("repositoryPath", repositoryPath),
 		zap.String("commit", obj.String()),
@@ -217,12 +161,21 @@ func BuildNewRepositoryHandler(logger *zap.Logger, config *jConfig.JudgeConfig,
 				"Folder name is required",
 			))
 		}
-		challengeInfo, err := challenge.ParseChallenge(logger, &config.Challenge, folderName)
+		catalog := challenge.GetCatalog(logger, &config.Challenge)
+		challengeInfo, err := catalog.Get(folderName)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
 				"Failed to parse challenge",
 			))
 		}
+		if problems := catalog.Problems(folderName); len(problems) > 0 {
+			logger.Error("Refusing to start a broken challenge",
+				zap.String("folder", folderName),
+				zap.String("problem", problems[0].String()))
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Challenge is broken",
+			))
+		}
 		startpoint := challengeInfo.FindStartPoint(startpointName)
 		if startpoint == nil {
 			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
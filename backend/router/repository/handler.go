@@ -15,6 +15,11 @@ func SetupRepositoryRouter(logger *zap.Logger, config *jConfig.JudgeConfig, db *
 		middleware.BuildAuthorizationMiddleWare(logger, config, db),
 		BuildNewRepositoryHandler(logger, config, db),
 	)
+	(*group).Put(
+		"/project/:repo/auto-test",
+		middleware.BuildAuthorizationMiddleWare(logger, config, db),
+		BuildSetAutoTestHandler(logger, config, db),
+	)
 	(*group).All(
 		"/git/*",
 		middleware.BuildGitAuthorizationMiddleWare(logger, config, db),
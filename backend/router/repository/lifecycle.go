@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"errors"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/tester"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	REPOSITORY_EVENT_ARCHIVE = "archive"
+	REPOSITORY_EVENT_DELETE  = "delete"
+	REPOSITORY_EVENT_RESTORE = "restore"
+	// recorded by the server, the events outlive the purged repository
+	REPOSITORY_EVENT_PURGE = "purge"
+)
+
+const DEFAULT_DELETE_GRACE_PERIOD_IN_DAY = 30
+const PURGE_INTERVAL = time.Hour
+
+var ErrRepositoryArchived = errors.New("repository is archived")
+var ErrRepositoryDeleted = errors.New("repository is deleted")
+var ErrRepositoryActive = errors.New("repository is neither archived nor deleted")
+
+// CheckRepositoryWritable refuses changes to archived and deleted repositories.
+func CheckRepositoryWritable(repositoryRecord *schema.Repository) error {
+	if repositoryRecord.DeleteTime != "" {
+		return ErrRepositoryDeleted
+	}
+	if repositoryRecord.ArchiveTime != "" {
+		return ErrRepositoryArchived
+	}
+	return nil
+}
+
+func deleteGracePeriod(config *jConfig.JudgeConfig) time.Duration {
+	days := config.RepositoryStorage.DeleteGracePeriodInDay
+	if days == 0 {
+		days = DEFAULT_DELETE_GRACE_PERIOD_IN_DAY
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// PurgeTime is when a deleted repository is removed for good, empty if it is not deleted.
+func PurgeTime(config *jConfig.JudgeConfig, repositoryRecord *schema.Repository) string {
+	deleteTime, err := time.Parse(time.RFC3339, repositoryRecord.DeleteTime)
+	if err != nil {
+		return ""
+	}
+	return deleteTime.Add(deleteGracePeriod(config)).UTC().Format(time.RFC3339)
+}
+
+// updateLifecycle sets the archive and delete times of a repository and records the event.
+func updateLifecycle(
+	db *gorm.DB,
+	repositoryRecord *schema.Repository,
+	action string,
+	archiveTime string,
+	deleteTime string,
+	provider string,
+	subject string,
+) error {
+	repositoryRecord.ArchiveTime = archiveTime
+	repositoryRecord.DeleteTime = deleteTime
+	repositoryRecord.UpdateTime = time.Now().UTC().Format(time.RFC3339)
+	err := db.Model(repositoryRecord).Updates(map[string]interface{}{
+		"archive_time": repositoryRecord.ArchiveTime,
+		"delete_time":  repositoryRecord.DeleteTime,
+		"update_time":  repositoryRecord.UpdateTime,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return RecordRepositoryEvent(db, &schema.RepositoryEvent{
+		RepositoryId:   repositoryRecord.RepositoryId,
+		Action:         action,
+		Provider:       provider,
+		Subject:        subject,
+		FromStartpoint: repositoryRecord.Startpoint,
+		ToStartpoint:   repositoryRecord.Startpoint,
+		FromStage:      repositoryRecord.Stage,
+		ToStage:        repositoryRecord.Stage,
+		KeepHistory:    true,
+	})
+}
+
+// ArchiveRepository makes a repository read-only, it can still be cloned and browsed.
+func ArchiveRepository(db *gorm.DB, repositoryRecord *schema.Repository, provider string, subject string) error {
+	if err := CheckRepositoryWritable(repositoryRecord); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	return updateLifecycle(db, repositoryRecord, REPOSITORY_EVENT_ARCHIVE, now, "", provider, subject)
+}
+
+// DeleteRepository hides a repository until it is purged, archived repositories may be deleted as well.
+func DeleteRepository(db *gorm.DB, repositoryRecord *schema.Repository, provider string, subject string) error {
+	if repositoryRecord.DeleteTime != "" {
+		return ErrRepositoryDeleted
+	}
+	inProgress, err := hasTestingInProgress(db, repositoryRecord.RepositoryId)
+	if err != nil {
+		return err
+	}
+	if inProgress {
+		return ErrTestingInProgress
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	return updateLifecycle(db, repositoryRecord, REPOSITORY_EVENT_DELETE, repositoryRecord.ArchiveTime, now, provider, subject)
+}
+
+// RestoreRepository brings an archived or deleted repository back to normal.
+func RestoreRepository(db *gorm.DB, repositoryRecord *schema.Repository, provider string, subject string) error {
+	if CheckRepositoryWritable(repositoryRecord) == nil {
+		return ErrRepositoryActive
+	}
+	return updateLifecycle(db, repositoryRecord, REPOSITORY_EVENT_RESTORE, "", "", provider, subject)
+}
+
+// purgeRepository removes the files and every record of a repository but its events.
+func purgeRepository(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB, repositoryRecord *schema.Repository) error {
+	if err := os.RemoveAll(tester.GetRepositoryPath(config, repositoryRecord)); err != nil {
+		return err
+	}
+	// left over by testings that did not clean up, named by the run id of executeTask in tester
+	leftovers, err := filepath.Glob(filepath.Join(
+		config.Testing.TmpStorageFolder,
+		strings.ToLower(repositoryRecord.RepositoryId)+"-*",
+	))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		if err := os.RemoveAll(leftover); err != nil {
+			logger.Error("Failed to remove temp storage", zap.String("path", leftover), zap.Error(err))
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		repositoryId := repositoryRecord.RepositoryId
+		for _, model := range []interface{}{
+			&schema.TestingCase{},
+			&schema.TestingStage{},
+			&schema.Testing{},
+			&schema.RepositoryTestingSerial{},
+			&schema.RepositoryStageScore{},
+			&schema.Repository{},
+		} {
+			if err := tx.Where("repository_id = ?", repositoryId).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return RecordRepositoryEvent(tx, &schema.RepositoryEvent{
+			RepositoryId:   repositoryId,
+			Action:         REPOSITORY_EVENT_PURGE,
+			FromStartpoint: repositoryRecord.Startpoint,
+			FromStage:      repositoryRecord.Stage,
+		})
+	})
+}
+
+// PurgeDeletedRepositories removes the repositories deleted longer than the grace period ago.
+func PurgeDeletedRepositories(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) {
+	// delete times are compared parsed, older rows were stored in the local zone of the server
+	deadline := time.Now().Add(-deleteGracePeriod(config))
+	var repositoryRecords []schema.Repository
+	err := db.Where("delete_time != ''").Find(&repositoryRecords).Error
+	if err != nil {
+		logger.Error("Failed to list deleted repositories", zap.Error(err))
+		return
+	}
+	for idx := range repositoryRecords {
+		deleteTime, err := time.Parse(time.RFC3339, repositoryRecords[idx].DeleteTime)
+		if err != nil {
+			logger.Error("Failed to parse delete time",
+				zap.String("repositoryId", repositoryRecords[idx].RepositoryId),
+				zap.Error(err))
+			continue
+		}
+		if deleteTime.After(deadline) {
+			continue
+		}
+		if err := purgeRepository(logger, config, db, &repositoryRecords[idx]); err != nil {
+			logger.Error("Failed to purge repository",
+				zap.String("repositoryId", repositoryRecords[idx].RepositoryId),
+				zap.Error(err))
+			continue
+		}
+		logger.Info("Purged repository", zap.String("repositoryId", repositoryRecords[idx].RepositoryId))
+	}
+}
+
+// WatchDeletedRepositories purges deleted repositories once their grace period is over, it never returns.
+func WatchDeletedRepositories(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) {
+	for {
+		PurgeDeletedRepositories(logger, config, db)
+		time.Sleep(PURGE_INTERVAL)
+	}
+}
@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/shared"
+	"judge/tester"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	REPOSITORY_EVENT_RESET             = "reset"
+	REPOSITORY_EVENT_SWITCH_STARTPOINT = "switchStartpoint"
+)
+
+var ErrTestingInProgress = errors.New("repository has testings in progress")
+
+// RecordRepositoryEvent appends an event to the audit trail of its repository.
+func RecordRepositoryEvent(db *gorm.DB, event *schema.RepositoryEvent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var last schema.RepositoryEvent
+		found := tx.Where("repository_id = ?", event.RepositoryId).Order("serial DESC").Limit(1).Find(&last)
+		if found.Error != nil {
+			return found.Error
+		}
+		event.Serial = last.Serial + 1
+		event.CreateTime = time.Now().UTC().Format(time.RFC3339)
+		return tx.Create(event).Error
+	})
+}
+
+func hasTestingInProgress(db *gorm.DB, repositoryId string) (bool, error) {
+	var count int64
+	err := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND status IN ?", repositoryId, []string{tester.StatusPending, tester.StatusRunning}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// commitStartpointFiles replaces the files of the checked out branch with those of the startpoint in a new commit.
+func commitStartpointFiles(repositoryPath string, startpointRootPath string, message string) error {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(repositoryPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == git.GitDirName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(repositoryPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if err := shared.CopyDir(startpointRootPath, repositoryPath); err != nil {
+		return err
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return err
+	}
+	// a repository that still has the startpoint files gets an empty commit, so the reset shows in the history
+	_, err = worktree.Commit(message, &git.CommitOptions{
+		Author:            botSignature(),
+		AllowEmptyCommits: true,
+	})
+	return err
+}
+
+// recreateRepositoryFiles replaces a repository with a new one created from the startpoint,
+// keeping the old one if that fails.
+func recreateRepositoryFiles(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	repositoryRecord *schema.Repository,
+	startpoint *challenge.StartPoint,
+) error {
+	repositoryPath := tester.GetRepositoryPath(config, repositoryRecord)
+	backupPath := repositoryPath + ".old"
+	if err := os.RemoveAll(backupPath); err != nil {
+		return err
+	}
+	if err := os.Rename(repositoryPath, backupPath); err != nil {
+		return err
+	}
+	err := createRepositoryFiles(
+		logger,
+		config,
+		repositoryRecord.Provider,
+		repositoryRecord.Subject,
+		repositoryRecord.ChallengeFolderName,
+		startpoint,
+		repositoryRecord.RepositoryId,
+	)
+	if err != nil {
+		os.RemoveAll(repositoryPath)
+		if err := os.Rename(backupPath, repositoryPath); err != nil {
+			logger.Error("Failed to restore repository",
+				zap.String("backupPath", backupPath),
+				zap.Error(err))
+		}
+		return err
+	}
+	return os.RemoveAll(backupPath)
+}
+
+// restartRepository puts the files of a startpoint back into a repository, on top of its history
+// if keepHistory is set, otherwise as a new repository with only the initial commit.
+func restartRepository(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	repositoryRecord *schema.Repository,
+	startpoint *challenge.StartPoint,
+	keepHistory bool,
+	event *schema.RepositoryEvent,
+) error {
+	// held from the check for testings in progress to the stage update,
+	// so no testing gets queued against a half rewritten repository
+	defer tester.LockRepository(repositoryRecord.RepositoryId)()
+	if err := CheckRepositoryWritable(repositoryRecord); err != nil {
+		return err
+	}
+	inProgress, err := hasTestingInProgress(db, repositoryRecord.RepositoryId)
+	if err != nil {
+		return err
+	}
+	if inProgress {
+		return ErrTestingInProgress
+	}
+
+	repositoryPath := tester.GetRepositoryPath(config, repositoryRecord)
+	// the checked out branch may be gone, the history is then empty
+	fromCommit, _ := shared.ResolveCommit(repositoryPath, "")
+	if keepHistory {
+		startpointRootPath := filepath.Join(
+			config.Challenge.StorageFolder,
+			repositoryRecord.ChallengeFolderName,
+			startpoint.Root,
+		)
+		err = commitStartpointFiles(repositoryPath, startpointRootPath, fmt.Sprintf("Restart from startpoint %s", startpoint.Name))
+	} else {
+		err = recreateRepositoryFiles(logger, config, repositoryRecord, startpoint)
+	}
+	if err != nil {
+		logger.Error("Failed to restart repository",
+			zap.String("repositoryId", repositoryRecord.RepositoryId),
+			zap.String("startpoint", startpoint.Name),
+			zap.Error(err))
+		return err
+	}
+	toCommit, err := shared.ResolveCommit(repositoryPath, "")
+	if err != nil {
+		return err
+	}
+
+	event.RepositoryId = repositoryRecord.RepositoryId
+	event.FromStartpoint = repositoryRecord.Startpoint
+	event.ToStartpoint = startpoint.Name
+	event.FromStage = repositoryRecord.Stage
+	event.FromCommit = fromCommit
+	event.ToCommit = toCommit
+	event.KeepHistory = keepHistory
+	repositoryRecord.Startpoint = startpoint.Name
+	repositoryRecord.Stage = event.ToStage
+	repositoryRecord.UpdateTime = time.Now().UTC().Format(time.RFC3339)
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(repositoryRecord).Updates(map[string]interface{}{
+			"startpoint":  repositoryRecord.Startpoint,
+			"stage":       repositoryRecord.Stage,
+			"update_time": repositoryRecord.UpdateTime,
+		}).Error
+		if err != nil {
+			return err
+		}
+		// a reset starts the scores over with the stages
+		if event.Action == REPOSITORY_EVENT_RESET {
+			err = tx.Where("repository_id = ?", repositoryRecord.RepositoryId).Delete(&schema.RepositoryStageScore{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return RecordRepositoryEvent(tx, event)
+	})
+}
+
+// ResetRepository starts a repository over from its startpoint at stage 0, dropping its best scores.
+// provider and subject are the user asking for it, for the audit trail.
+func ResetRepository(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	repositoryRecord *schema.Repository,
+	startpoint *challenge.StartPoint,
+	keepHistory bool,
+	provider string,
+	subject string,
+) error {
+	return restartRepository(logger, config, db, repositoryRecord, startpoint, keepHistory, &schema.RepositoryEvent{
+		Action:   REPOSITORY_EVENT_RESET,
+		Provider: provider,
+		Subject:  subject,
+		ToStage:  0,
+	})
+}
+
+// SwitchStartpoint moves a repository to another startpoint of its challenge, keeping its stage.
+func SwitchStartpoint(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	repositoryRecord *schema.Repository,
+	startpoint *challenge.StartPoint,
+	keepHistory bool,
+	provider string,
+	subject string,
+) error {
+	return restartRepository(logger, config, db, repositoryRecord, startpoint, keepHistory, &schema.RepositoryEvent{
+		Action:   REPOSITORY_EVENT_SWITCH_STARTPOINT,
+		Provider: provider,
+		Subject:  subject,
+		ToStage:  repositoryRecord.Stage,
+	})
+}
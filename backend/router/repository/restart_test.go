@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"errors"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/tester"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// newTestRestart creates a repository at stage 2 from a startpoint with one commit of the student on top.
+func newTestRestart(t *testing.T) (*jConfig.JudgeConfig, *gorm.DB, *schema.Repository, *challenge.StartPoint) {
+	t.Helper()
+	config := &jConfig.JudgeConfig{}
+	config.Challenge.StorageFolder = t.TempDir()
+	config.RepositoryStorage.StorageFolder = t.TempDir()
+	startpoint := &challenge.StartPoint{Name: "go", Root: "start"}
+	startpointRootPath := filepath.Join(config.Challenge.StorageFolder, "hello", startpoint.Root)
+	if err := os.MkdirAll(startpointRootPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(startpointRootPath, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repositoryRecord := &schema.Repository{
+		RepositoryId:        "repo",
+		Provider:            "provider",
+		Subject:             "subject",
+		ChallengeFolderName: "hello",
+		Startpoint:          startpoint.Name,
+		Stage:               2,
+	}
+	logger := zap.NewNop()
+	err := createRepositoryFiles(logger, config, "provider", "subject", "hello", startpoint, repositoryRecord.RepositoryId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositoryPath := tester.GetRepositoryPath(config, repositoryRecord)
+	if err := os.WriteFile(filepath.Join(repositoryPath, "solution.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("solution.go"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("solve", &git.CommitOptions{
+		Author: &object.Signature{Name: "student", Email: "student@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "judge.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&schema.Repository{}, &schema.Testing{}, &schema.RepositoryStageScore{}, &schema.RepositoryEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Create(repositoryRecord)
+	db.Create(&schema.RepositoryStageScore{RepositoryId: "repo", Stage: 0, Score: 1})
+	db.Create(&schema.RepositoryStageScore{RepositoryId: "repo", Stage: 1, Score: 1})
+	return config, db, repositoryRecord, startpoint
+}
+
+func countCommits(t *testing.T, repositoryPath string) int {
+	t.Helper()
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	commits.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+func TestResetRepository(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepHistory bool
+		inProgress  bool
+		wantErr     error
+		wantCommits int
+		wantStage   int32
+		wantScores  int64
+		wantEvents  int64
+	}{
+		{name: "keeping history", keepHistory: true, wantCommits: 3, wantStage: 0, wantScores: 0, wantEvents: 1},
+		{name: "without history", keepHistory: false, wantCommits: 1, wantStage: 0, wantScores: 0, wantEvents: 1},
+		{
+			name:        "testing in progress",
+			keepHistory: true,
+			inProgress:  true,
+			wantErr:     ErrTestingInProgress,
+			wantCommits: 2,
+			wantStage:   2,
+			wantScores:  2,
+			wantEvents:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, db, repositoryRecord, startpoint := newTestRestart(t)
+			if tt.inProgress {
+				db.Create(&schema.Testing{RepositoryId: "repo", Serial: 1, Status: tester.StatusPending})
+			}
+
+			err := ResetRepository(zap.NewNop(), config, db, repositoryRecord, startpoint, tt.keepHistory, "provider", "subject")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			repositoryPath := tester.GetRepositoryPath(config, repositoryRecord)
+			if commits := countCommits(t, repositoryPath); commits != tt.wantCommits {
+				t.Errorf("commits = %d, want %d", commits, tt.wantCommits)
+			}
+			_, statErr := os.Stat(filepath.Join(repositoryPath, "solution.go"))
+			if tt.wantErr == nil && statErr == nil {
+				t.Error("files of the student are left after the reset")
+			}
+			if tt.wantErr != nil && statErr != nil {
+				t.Errorf("files of the student are gone after a refused reset: %v", statErr)
+			}
+			var saved schema.Repository
+			db.Where("repository_id = ?", "repo").First(&saved)
+			if saved.Stage != tt.wantStage {
+				t.Errorf("stage = %d, want %d", saved.Stage, tt.wantStage)
+			}
+			var scores, events int64
+			db.Model(&schema.RepositoryStageScore{}).Count(&scores)
+			db.Model(&schema.RepositoryEvent{}).Count(&events)
+			if scores != tt.wantScores || events != tt.wantEvents {
+				t.Errorf("%d scores and %d events, want %d and %d", scores, events, tt.wantScores, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestResetRepositoryWaitsForRepositoryLock(t *testing.T) {
+	config, db, repositoryRecord, startpoint := newTestRestart(t)
+	// stands in for a testing being queued
+	unlock := tester.LockRepository(repositoryRecord.RepositoryId)
+	done := make(chan error)
+	go func() {
+		done <- ResetRepository(zap.NewNop(), config, db, repositoryRecord, startpoint, true, "provider", "subject")
+	}()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("reset did not wait for the lock, err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
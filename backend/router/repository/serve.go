@@ -4,9 +4,12 @@ import (
 	"judge/jConfig"
 	"judge/middleware"
 	"judge/router"
+	"judge/schema"
 	"judge/shared"
+	"judge/tester"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,6 +19,67 @@ import (
 	"gorm.io/gorm"
 )
 
+const RECEIVE_PACK_SUFFIX = "/git-receive-pack"
+
+// pushedCommit picks the commit to test after a push, preferring the branch HEAD points at.
+// It is empty if the push updated no branch, e.g. it was rejected or only deleted branches.
+func pushedCommit(before map[string]string, after map[string]string, head string) string {
+	if hash, ok := after[head]; ok && before[head] != hash {
+		return hash
+	}
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if before[name] != after[name] {
+			return after[name]
+		}
+	}
+	return ""
+}
+
+// triggerAutoTest queues a testing of the pushed commit for the current stage of the repository.
+func triggerAutoTest(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	repoId string,
+	repositoryPath string,
+	branchesBefore map[string]string,
+) {
+	branchesAfter, head, err := shared.ListBranches(repositoryPath)
+	if err != nil {
+		logger.Error("Failed to list branches", zap.Error(err))
+		return
+	}
+	commit := pushedCommit(branchesBefore, branchesAfter, head)
+	if commit == "" {
+		return
+	}
+	repositoryRecord := &schema.Repository{}
+	if err := db.Where("repository_id = ?", repoId).First(repositoryRecord).Error; err != nil {
+		logger.Error("Failed to get repository record", zap.Error(err))
+		return
+	}
+	if !repositoryRecord.AutoTest {
+		logger.Debug("Auto test disabled", zap.String("repoId", repoId))
+		return
+	}
+	testingRecord, err := tester.PushToPending(logger, config, db, repoId, int(repositoryRecord.Stage), commit, nil)
+	if err != nil {
+		// the push itself succeeded, the student may still request the testing by hand
+		logger.Error("Failed to push to pending", zap.Error(err))
+		return
+	}
+	logger.Info("Auto test queued",
+		zap.String("repoId", repoId),
+		zap.Int32("serial", testingRecord.Serial),
+		zap.String("commit", commit),
+	)
+}
+
 func BuildGitServerHandler(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
@@ -57,6 +121,27 @@ func BuildGitServerHandler(
 			))
 		}
 
+		// repositories without a record are still created on the fly by gitkit
+		repositoryRecord := &schema.Repository{}
+		found := db.Where("repository_id = ?", repoId).Limit(1).Find(repositoryRecord)
+		if found.Error != nil {
+			logger.Error("Failed to get repository record", zap.Error(found.Error))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to get repository",
+			))
+		}
+		if repositoryRecord.DeleteTime != "" {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Repository not found",
+			))
+		}
+		isPush := strings.HasSuffix(suf, RECEIVE_PACK_SUFFIX) || c.Query("service") == middleware.RECEIVE_PACK_SERVICE
+		if isPush && repositoryRecord.ArchiveTime != "" {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError(
+				"Repository is archived, pushes are refused",
+			))
+		}
+
 		repoRoot := filepath.Join(
 			config.RepositoryStorage.StorageFolder,
 			provider,
@@ -74,6 +159,16 @@ func BuildGitServerHandler(
 					r.URL.Path = "/" + r.URL.Path
 				}
 				logger.Debug("Git server request", zap.String("path", r.URL.Path))
+				repositoryPath := filepath.Join(repoRoot, repoId)
+				isReceivePack := r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, RECEIVE_PACK_SUFFIX)
+				var branchesBefore map[string]string
+				if isReceivePack {
+					branches, _, err := shared.ListBranches(repositoryPath)
+					if err != nil {
+						logger.Error("Failed to list branches", zap.Error(err))
+					}
+					branchesBefore = branches
+				}
 				gitkit.New(
 					gitkit.Config{
 						Dir:        repoRoot,
@@ -81,6 +176,9 @@ func BuildGitServerHandler(
 						AutoCreate: true,
 					},
 				).ServeHTTP(w, r)
+				if isReceivePack && branchesBefore != nil {
+					triggerAutoTest(logger, config, db, repoId, repositoryPath, branchesBefore)
+				}
 			},
 		)
 
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"judge/jConfig"
+	"judge/middleware"
+	"judge/router"
+	"judge/schema"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func BuildSetAutoTestHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		repoId := c.Params("repo")
+		enabled := c.QueryBool("enabled", true)
+
+		repositoryRecord := &schema.Repository{}
+		if err := db.Where("repository_id = ?", repoId).First(repositoryRecord).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Repository not found",
+			))
+		}
+		if repositoryRecord.Provider != c.Locals(middleware.PROVIDER_LOCAL_KEY).(string) ||
+			repositoryRecord.Subject != c.Locals(middleware.SUBJECT_LOCAL_KEY).(string) {
+			return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError(
+				"Subject mismatch",
+			))
+		}
+
+		// update by column, a struct update would skip false
+		err := db.Model(repositoryRecord).Updates(map[string]interface{}{
+			"auto_test":   enabled,
+			"update_time": time.Now().Format(time.RFC3339),
+		}).Error
+		if err != nil {
+			logger.Error("Failed to update repository record", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to update repository",
+			))
+		}
+		return c.JSON(router.BuildResponse(
+			struct {
+				RepositoryId string `json:"repositoryId"`
+				AutoTest     bool   `json:"autoTest"`
+			}{
+				RepositoryId: repoId,
+				AutoTest:     enabled,
+			},
+		))
+	}
+}
@@ -0,0 +1,295 @@
+package repository
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/shared"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+const (
+	SSH_PROVIDER_EXTENSION = "provider"
+	SSH_SUBJECT_EXTENSION  = "subject"
+	UPLOAD_PACK_COMMAND    = "git-upload-pack"
+	RECEIVE_PACK_COMMAND   = "git-receive-pack"
+)
+
+var ErrUnknownPublicKey = errors.New("unknown public key")
+var ErrInvalidSshCommand = errors.New("only git-upload-pack and git-receive-pack of /{provider}/{subject}/{challenge}/{repoId} are supported")
+
+// sshGitCommand is a git command of an ssh session, e.g. git-upload-pack '/provider/subject/challenge/repoId'.
+type sshGitCommand struct {
+	Command             string
+	Provider            string
+	Subject             string
+	ChallengeFolderName string
+	RepoId              string
+}
+
+func parseSshGitCommand(command string) (*sshGitCommand, error) {
+	name, argument, ok := strings.Cut(command, " ")
+	if !ok || (name != UPLOAD_PACK_COMMAND && name != RECEIVE_PACK_COMMAND) {
+		return nil, ErrInvalidSshCommand
+	}
+	argument = strings.TrimSuffix(strings.TrimPrefix(argument, "'"), "'")
+	if strings.Contains(argument, "'") {
+		return nil, ErrInvalidSshCommand
+	}
+	// both ssh://host/provider/... and host:provider/... are accepted
+	parts := strings.Split(strings.Trim(argument, "/"), "/")
+	if len(parts) != 4 {
+		return nil, ErrInvalidSshCommand
+	}
+	for _, part := range parts {
+		if !filepath.IsLocal(part) {
+			return nil, ErrInvalidSshCommand
+		}
+	}
+	return &sshGitCommand{
+		Command:             name,
+		Provider:            parts[0],
+		Subject:             parts[1],
+		ChallengeFolderName: parts[2],
+		RepoId:              strings.TrimSuffix(parts[3], ".git"),
+	}, nil
+}
+
+// loadHostKey reads the private key of the server, generating one on the first start.
+func loadHostKey(logger *zap.Logger, path string) (ssh.Signer, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(privateKey, "judge host key")
+		if err != nil {
+			return nil, err
+		}
+		content = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			return nil, err
+		}
+		logger.Info("Generated ssh host key", zap.String("path", path))
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(content)
+}
+
+// runSshGitCommand serves a git command after the same checks as BuildGitServerHandler,
+// it returns the exit status for the client.
+func runSshGitCommand(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	permissions *ssh.Permissions,
+	channel ssh.Channel,
+	env []string,
+	command string,
+) uint32 {
+	gitCommand, err := parseSshGitCommand(command)
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 1
+	}
+	logger.Debug(
+		"Git ssh request",
+		zap.String("command", gitCommand.Command),
+		zap.String("provider", gitCommand.Provider),
+		zap.String("subject", gitCommand.Subject),
+		zap.String("challengeFolderName", gitCommand.ChallengeFolderName),
+		zap.String("repoId", gitCommand.RepoId),
+	)
+	if gitCommand.Subject != permissions.Extensions[SSH_SUBJECT_EXTENSION] {
+		fmt.Fprintln(channel.Stderr(), "Subject mismatch")
+		return 1
+	}
+	if gitCommand.Provider != permissions.Extensions[SSH_PROVIDER_EXTENSION] {
+		fmt.Fprintln(channel.Stderr(), "Provider mismatch")
+		return 1
+	}
+	// unlike over http, repositories are never created on the fly
+	var repositoryRecord schema.Repository
+	found := db.Where("repository_id = ? AND subject = ? AND provider = ? AND challenge_folder_name = ?",
+		gitCommand.RepoId, gitCommand.Subject, gitCommand.Provider, gitCommand.ChallengeFolderName).
+		Limit(1).Find(&repositoryRecord)
+	if found.Error != nil || found.RowsAffected == 0 || repositoryRecord.DeleteTime != "" {
+		fmt.Fprintln(channel.Stderr(), "Repository not found")
+		return 1
+	}
+	isReceivePack := gitCommand.Command == RECEIVE_PACK_COMMAND
+	if isReceivePack && repositoryRecord.ArchiveTime != "" {
+		fmt.Fprintln(channel.Stderr(), "Repository is archived, pushes are refused")
+		return 1
+	}
+
+	repositoryPath := filepath.Join(
+		config.RepositoryStorage.StorageFolder,
+		gitCommand.Provider,
+		gitCommand.Subject,
+		gitCommand.ChallengeFolderName,
+		gitCommand.RepoId,
+	)
+	var branchesBefore map[string]string
+	if isReceivePack {
+		branches, _, err := shared.ListBranches(repositoryPath)
+		if err != nil {
+			logger.Error("Failed to list branches", zap.Error(err))
+		}
+		branchesBefore = branches
+	}
+
+	cmd := exec.Command("git", strings.TrimPrefix(gitCommand.Command, "git-"), repositoryPath)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	// the client keeps its side open, so stdin must not hold up Wait
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Error("Failed to open stdin of git", zap.Error(err))
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		logger.Error("Failed to start git", zap.Error(err))
+		return 1
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	if isReceivePack && branchesBefore != nil {
+		triggerAutoTest(logger, config, db, gitCommand.RepoId, repositoryPath, branchesBefore)
+	}
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return uint32(exitError.ExitCode())
+	}
+	if err != nil {
+		logger.Error("Failed to run git", zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+func handleSshSession(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	permissions *ssh.Permissions,
+	channel ssh.Channel,
+	requests <-chan *ssh.Request,
+) {
+	defer channel.Close()
+	var env []string
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			var variable struct{ Name, Value string }
+			// only the protocol version is passed on, it enables git protocol v2
+			if ssh.Unmarshal(request.Payload, &variable) == nil && variable.Name == "GIT_PROTOCOL" {
+				env = append(env, "GIT_PROTOCOL="+variable.Value)
+				request.Reply(true, nil)
+			} else {
+				request.Reply(false, nil)
+			}
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				request.Reply(false, nil)
+				return
+			}
+			request.Reply(true, nil)
+			status := runSshGitCommand(logger, config, db, permissions, channel, env, payload.Command)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "shell":
+			request.Reply(true, nil)
+			fmt.Fprintf(channel.Stderr(), "Hi %s, there is no shell access, use git instead.\r\n",
+				permissions.Extensions[SSH_SUBJECT_EXTENSION])
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+func handleSshConnection(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	sshConfig *ssh.ServerConfig,
+	conn net.Conn,
+) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		logger.Debug("Failed ssh handshake", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			logger.Error("Failed to accept ssh channel", zap.Error(err))
+			continue
+		}
+		go handleSshSession(logger, config, db, serverConn.Permissions, channel, channelRequests)
+	}
+}
+
+// ServeSsh serves git over ssh, users are identified by the public keys added at /user/keys.
+func ServeSsh(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) error {
+	hostKey, err := loadHostKey(logger, config.Ssh.HostKeyPath)
+	if err != nil {
+		return err
+	}
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// clients offer every key they have, so unknown ones are common and not logged
+			var keyRecord schema.UserPublicKey
+			found := db.Where("fingerprint = ?", ssh.FingerprintSHA256(key)).Limit(1).Find(&keyRecord)
+			if found.Error != nil || found.RowsAffected == 0 {
+				return nil, ErrUnknownPublicKey
+			}
+			return &ssh.Permissions{Extensions: map[string]string{
+				SSH_PROVIDER_EXTENSION: keyRecord.Provider,
+				SSH_SUBJECT_EXTENSION:  keyRecord.Subject,
+			}}, nil
+		},
+	}
+	sshConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Ssh.HostAddr, config.Ssh.HostPort))
+	if err != nil {
+		return err
+	}
+	logger.Info("Ssh server started", zap.String("address", listener.Addr().String()))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSshConnection(logger, config, db, sshConfig, conn)
+	}
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSshGitCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    *sshGitCommand
+		wantErr error
+	}{
+		{
+			name:    "scp-like path",
+			command: "git-upload-pack 'github/alice/hello/abc.git'",
+			want:    &sshGitCommand{Command: UPLOAD_PACK_COMMAND, Provider: "github", Subject: "alice", ChallengeFolderName: "hello", RepoId: "abc"},
+		},
+		{
+			name:    "ssh url path",
+			command: "git-receive-pack '/github/alice/hello/abc.git'",
+			want:    &sshGitCommand{Command: RECEIVE_PACK_COMMAND, Provider: "github", Subject: "alice", ChallengeFolderName: "hello", RepoId: "abc"},
+		},
+		{
+			name:    "without .git",
+			command: "git-upload-pack 'github/alice/hello/abc'",
+			want:    &sshGitCommand{Command: UPLOAD_PACK_COMMAND, Provider: "github", Subject: "alice", ChallengeFolderName: "hello", RepoId: "abc"},
+		},
+		{name: "other command", command: "git-upload-archive 'github/alice/hello/abc.git'", wantErr: ErrInvalidSshCommand},
+		{name: "shell", command: "sh -c 'id'", wantErr: ErrInvalidSshCommand},
+		{name: "no argument", command: "git-upload-pack", wantErr: ErrInvalidSshCommand},
+		{name: "too short", command: "git-upload-pack 'github/alice/abc.git'", wantErr: ErrInvalidSshCommand},
+		{name: "too long", command: "git-upload-pack 'github/alice/hello/abc/def.git'", wantErr: ErrInvalidSshCommand},
+		{name: "parent folder", command: "git-upload-pack 'github/alice/../abc.git'", wantErr: ErrInvalidSshCommand},
+		{name: "quote injection", command: "git-upload-pack 'github/alice/hello/abc.git'; id '", wantErr: ErrInvalidSshCommand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSshGitCommand(tt.command)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSshGitCommand(%q) = %+v, want %+v", tt.command, got, tt.want)
+			}
+		})
+	}
+}
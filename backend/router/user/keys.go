@@ -0,0 +1,132 @@
+package user
+
+import (
+	"judge/jConfig"
+	"judge/middleware"
+	"judge/router"
+	"judge/schema"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+type publicKeyResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name"`
+	Content     string `json:"content"`
+	CreateTime  string `json:"createTime"`
+}
+
+type addPublicKeyRequest struct {
+	Name string `json:"name"`
+	// a line of authorized_keys, e.g. the content of ~/.ssh/id_ed25519.pub
+	Key string `json:"key"`
+}
+
+func BuildUserKeysHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		var keyRecords []schema.UserPublicKey
+		err := db.Where("subject = ? AND provider = ?", subject, provider).
+			Order("create_time").Find(&keyRecords).Error
+		if err != nil {
+			logger.Error("Failed to list public keys", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to list public keys"))
+		}
+		keys := make([]publicKeyResponse, 0, len(keyRecords))
+		for _, keyRecord := range keyRecords {
+			keys = append(keys, publicKeyResponse{
+				Fingerprint: keyRecord.Fingerprint,
+				Name:        keyRecord.Name,
+				Content:     keyRecord.Content,
+				CreateTime:  keyRecord.CreateTime,
+			})
+		}
+		return c.JSON(router.BuildResponse(keys))
+	}
+}
+
+func BuildUserAddKeyHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if usedAccessToken(c) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access tokens cannot add public keys"))
+		}
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		var request addPublicKeyRequest
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("Invalid request"))
+		}
+		publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(request.Key))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("Invalid public key"))
+		}
+		name := strings.TrimSpace(request.Name)
+		if name == "" {
+			name = comment
+		}
+		keyRecord := schema.UserPublicKey{
+			Fingerprint: ssh.FingerprintSHA256(publicKey),
+			Subject:     subject,
+			Provider:    provider,
+			Name:        name,
+			Content:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+			CreateTime:  time.Now().Format(time.RFC3339),
+		}
+		var count int64
+		if err := db.Model(&schema.UserPublicKey{}).Where("fingerprint = ?", keyRecord.Fingerprint).Count(&count).Error; err != nil {
+			logger.Error("Failed to look up public key", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to add public key"))
+		}
+		// the key identifies the user over ssh, so it cannot be shared
+		if count > 0 {
+			return c.Status(fiber.StatusConflict).JSON(router.BuildError("Public key is already in use"))
+		}
+		if err := db.Create(&keyRecord).Error; err != nil {
+			logger.Error("Failed to add public key", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to add public key"))
+		}
+		return c.JSON(router.BuildResponse(publicKeyResponse{
+			Fingerprint: keyRecord.Fingerprint,
+			Name:        keyRecord.Name,
+			Content:     keyRecord.Content,
+			CreateTime:  keyRecord.CreateTime,
+		}))
+	}
+}
+
+func BuildUserDeleteKeyHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if usedAccessToken(c) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access tokens cannot delete public keys"))
+		}
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		// fingerprints are base64 and never contain spaces, a + that was not escaped arrives as one
+		fingerprint := strings.ReplaceAll(c.Query("fingerprint"), " ", "+")
+		if fingerprint == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("No fingerprint found"))
+		}
+		result := db.Where("fingerprint = ? AND subject = ? AND provider = ?", fingerprint, subject, provider).
+			Delete(&schema.UserPublicKey{})
+		if result.Error != nil {
+			logger.Error("Failed to delete public key", zap.Error(result.Error))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to delete public key"))
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError("Public key not found"))
+		}
+		return c.JSON(router.BuildResponse(
+			struct {
+				Deleted bool `json:"deleted"`
+			}{
+				Deleted: true,
+			},
+		))
+	}
+}
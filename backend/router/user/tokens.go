@@ -0,0 +1,155 @@
+package user
+
+import (
+	"crypto/rand"
+	"judge/jConfig"
+	"judge/middleware"
+	"judge/router"
+	"judge/schema"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type accessTokenResponse struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	ExpireTime   string   `json:"expireTime"`
+	LastUsedTime string   `json:"lastUsedTime"`
+	CreateTime   string   `json:"createTime"`
+	// only set when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+type createAccessTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// 0 for a token that never expires
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+func buildAccessTokenResponse(tokenRecord *schema.UserAccessToken) accessTokenResponse {
+	return accessTokenResponse{
+		Id:           tokenRecord.Id,
+		Name:         tokenRecord.Name,
+		Scopes:       middleware.TokenScopes(tokenRecord),
+		ExpireTime:   tokenRecord.ExpireTime,
+		LastUsedTime: tokenRecord.LastUsedTime,
+		CreateTime:   tokenRecord.CreateTime,
+	}
+}
+
+func BuildUserTokensHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		var tokenRecords []schema.UserAccessToken
+		err := db.Where("subject = ? AND provider = ?", subject, provider).
+			Order("create_time").Find(&tokenRecords).Error
+		if err != nil {
+			logger.Error("Failed to list access tokens", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to list access tokens"))
+		}
+		tokens := make([]accessTokenResponse, 0, len(tokenRecords))
+		for idx := range tokenRecords {
+			tokens = append(tokens, buildAccessTokenResponse(&tokenRecords[idx]))
+		}
+		return c.JSON(router.BuildResponse(tokens))
+	}
+}
+
+func BuildUserCreateTokenHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if usedAccessToken(c) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access tokens cannot create access tokens"))
+		}
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		var request createAccessTokenRequest
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("Invalid request"))
+		}
+		name := strings.TrimSpace(request.Name)
+		if name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("No name found"))
+		}
+		if len(request.Scopes) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("No scopes found"))
+		}
+		scopes := make([]string, 0, len(request.Scopes))
+		for _, scope := range request.Scopes {
+			if !slices.Contains(middleware.TOKEN_SCOPES, scope) {
+				return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("Unknown scope " + scope))
+			}
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		if request.ExpiresInDays < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError("Invalid expiresInDays"))
+		}
+
+		token, err := middleware.GenerateAccessToken()
+		if err != nil {
+			logger.Error("Failed to generate access token", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to create access token"))
+		}
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			logger.Error("Failed to generate access token id", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to create access token"))
+		}
+		now := time.Now()
+		tokenRecord := schema.UserAccessToken{
+			Id:         base58.Encode(id),
+			Subject:    subject,
+			Provider:   provider,
+			Name:       name,
+			TokenHash:  middleware.HashAccessToken(token),
+			Scopes:     strings.Join(scopes, ","),
+			CreateTime: now.Format(time.RFC3339),
+		}
+		if request.ExpiresInDays > 0 {
+			tokenRecord.ExpireTime = now.AddDate(0, 0, request.ExpiresInDays).Format(time.RFC3339)
+		}
+		if err := db.Create(&tokenRecord).Error; err != nil {
+			logger.Error("Failed to create access token", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to create access token"))
+		}
+		response := buildAccessTokenResponse(&tokenRecord)
+		response.Token = token
+		return c.JSON(router.BuildResponse(response))
+	}
+}
+
+func BuildUserRevokeTokenHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if usedAccessToken(c) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access tokens cannot revoke access tokens"))
+		}
+		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
+		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
+		result := db.Where("id = ? AND subject = ? AND provider = ?", c.Params("id"), subject, provider).
+			Delete(&schema.UserAccessToken{})
+		if result.Error != nil {
+			logger.Error("Failed to revoke access token", zap.Error(result.Error))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError("Failed to revoke access token"))
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError("Access token not found"))
+		}
+		return c.JSON(router.BuildResponse(
+			struct {
+				Revoked bool `json:"revoked"`
+			}{
+				Revoked: true,
+			},
+		))
+	}
+}
@@ -13,6 +13,13 @@ import (
 	"gorm.io/gorm"
 )
 
+// usedAccessToken tells if a request was made with a personal access token.
+// Such requests may not create credentials, tokens, ssh keys or the git password,
+// so a leaked token cannot be turned into access that outlives its scopes, expiry and revocation.
+func usedAccessToken(c *fiber.Ctx) bool {
+	return c.Locals(middleware.ACCESS_TOKEN_LOCAL_KEY) != nil
+}
+
 func BuildUserInfoHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userInfo := c.Locals(middleware.USER_INFO_LOCAL_KEY).(string)
@@ -32,6 +39,9 @@ func BuildUserInfoHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *g
 
 func BuildUserUpdateGitPasswordHandler(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		if usedAccessToken(c) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError("Access tokens cannot update the password"))
+		}
 		subject := c.Locals(middleware.SUBJECT_LOCAL_KEY).(string)
 		provider := c.Locals(middleware.PROVIDER_LOCAL_KEY).(string)
 		newPassword := c.Query("newPassword")
@@ -90,6 +100,12 @@ func SetupUserRouter(logger *zap.Logger, config *jConfig.JudgeConfig, db *gorm.D
 	(*group).Get("/info", BuildUserInfoHandler(logger, config, db))
 	(*group).Post("/password", BuildUserUpdateGitPasswordHandler(logger, config, db))
 	(*group).Get("/name", BuildUserGitNameHandler(logger, config, db))
+	(*group).Get("/keys", BuildUserKeysHandler(logger, config, db))
+	(*group).Post("/keys", BuildUserAddKeyHandler(logger, config, db))
+	(*group).Delete("/keys", BuildUserDeleteKeyHandler(logger, config, db))
+	(*group).Get("/tokens", BuildUserTokensHandler(logger, config, db))
+	(*group).Post("/tokens", BuildUserCreateTokenHandler(logger, config, db))
+	(*group).Delete("/tokens/:id", BuildUserRevokeTokenHandler(logger, config, db))
 	(*group).Get("/subject", func(c *fiber.Ctx) error {
 		return c.JSON(router.BuildResponse(
 			struct {
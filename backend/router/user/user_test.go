@@ -0,0 +1,113 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"judge/jConfig"
+	"judge/middleware"
+	"judge/schema"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+func newTestUserApp(t *testing.T, accessToken bool) (*fiber.App, *gorm.DB) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "judge.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&schema.UserAccessToken{}, &schema.UserPublicKey{}, &schema.UserBasicAuthentication{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	// stands in for the authorization middleware
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(middleware.SUBJECT_LOCAL_KEY, "subject")
+		c.Locals(middleware.PROVIDER_LOCAL_KEY, "provider")
+		if accessToken {
+			c.Locals(middleware.ACCESS_TOKEN_LOCAL_KEY, &schema.UserAccessToken{Id: "id", Subject: "subject", Provider: "provider"})
+		}
+		return c.Next()
+	})
+	logger := zap.NewNop()
+	config := &jConfig.JudgeConfig{}
+	app.Post("/user/password", BuildUserUpdateGitPasswordHandler(logger, config, db))
+	app.Post("/user/keys", BuildUserAddKeyHandler(logger, config, db))
+	app.Delete("/user/keys", BuildUserDeleteKeyHandler(logger, config, db))
+	app.Post("/user/tokens", BuildUserCreateTokenHandler(logger, config, db))
+	app.Delete("/user/tokens/:id", BuildUserRevokeTokenHandler(logger, config, db))
+	return app, db
+}
+
+func TestCredentialHandlersRefuseAccessTokens(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	existingKey := schema.UserPublicKey{Fingerprint: "SHA256:existing", Subject: "subject", Provider: "provider"}
+	existingToken := schema.UserAccessToken{Id: "existing", Subject: "subject", Provider: "provider", TokenHash: "hash"}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "update password", method: http.MethodPost, target: "/user/password?newPassword=secret"},
+		{name: "add key", method: http.MethodPost, target: "/user/keys", body: `{"name": "laptop", "key": "` + publicKey + `"}`},
+		{name: "delete key", method: http.MethodDelete, target: "/user/keys?fingerprint=" + url.QueryEscape(existingKey.Fingerprint)},
+		{name: "create token", method: http.MethodPost, target: "/user/tokens", body: `{"name": "ci", "scopes": ["api"]}`},
+		{name: "revoke token", method: http.MethodDelete, target: "/user/tokens/" + existingToken.Id},
+	}
+	for _, tt := range tests {
+		for _, accessToken := range []bool{true, false} {
+			name := tt.name + " with oauth"
+			wantStatus := fiber.StatusOK
+			if accessToken {
+				name = tt.name + " with access token"
+				wantStatus = fiber.StatusForbidden
+			}
+			t.Run(name, func(t *testing.T) {
+				app, db := newTestUserApp(t, accessToken)
+				db.Create(&existingKey)
+				db.Create(&existingToken)
+
+				request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+				request.Header.Set("Content-Type", "application/json")
+				response, err := app.Test(request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if response.StatusCode != wantStatus {
+					t.Fatalf("status = %d, want %d", response.StatusCode, wantStatus)
+				}
+				if !accessToken {
+					return
+				}
+				var keys, tokens, passwords int64
+				db.Model(&schema.UserPublicKey{}).Count(&keys)
+				db.Model(&schema.UserAccessToken{}).Count(&tokens)
+				db.Model(&schema.UserBasicAuthentication{}).Count(&passwords)
+				if keys != 1 || tokens != 1 || passwords != 0 {
+					t.Errorf("credentials changed: %d keys, %d tokens, %d passwords", keys, tokens, passwords)
+				}
+			})
+		}
+	}
+}
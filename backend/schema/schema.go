@@ -12,9 +12,62 @@ type Testing struct {
 	Status       string
 	Message      string
 	Log          string
+	BuildLog     string
 	CreateTime   string
 	RunStartTime string
 	RunEndTime   string
+	// hash of the tested commit, and whether every earlier stage is run as well
+	Commit     string
+	Regression bool
+	// lease of the worker running this testing, empty unless running
+	LeaseOwner      string
+	LeaseExpireTime string
+}
+
+// TestingStage is the result of one of the stages run by a testing.
+type TestingStage struct {
+	RepositoryId string `gorm:"primaryKey"`
+	Serial       int32  `gorm:"primaryKey"`
+	Stage        int32  `gorm:"primaryKey"`
+	Status       string
+	Message      string
+	Score        float64
+	MaxScore     float64
+}
+
+// RepositoryStageScore is the best score a repository got for a stage.
+type RepositoryStageScore struct {
+	RepositoryId string `gorm:"primaryKey"`
+	Stage        int32  `gorm:"primaryKey"`
+	Score        float64
+	// testing that first reached the score
+	Serial     int32
+	UpdateTime string
+}
+
+// StartpointVerification is the result of running the reference solution of a startpoint for one stage.
+type StartpointVerification struct {
+	ChallengeFolderName string `gorm:"primaryKey"`
+	Startpoint          string `gorm:"primaryKey"`
+	Stage               int32  `gorm:"primaryKey"`
+	Status              string
+	Message             string
+	VerifyTime          string
+	// of the challenge folder that was verified, see challenge.Fingerprint
+	Fingerprint string
+}
+
+// TestingCase is one case of a structured report.
+type TestingCase struct {
+	RepositoryId          string `gorm:"primaryKey"`
+	Serial                int32  `gorm:"primaryKey"`
+	Position              int32  `gorm:"primaryKey"`
+	Stage                 int32
+	Name                  string
+	ClassName             string
+	Status                string
+	DurationInMillisecond int32
+	Output                string
 }
 
 type User struct {
@@ -37,6 +90,34 @@ type UserBasicAuthentication struct {
 	AuthenticationText string
 }
 
+// UserAccessToken is a personal access token, used instead of oauth by scripts and instead of the password by git.
+type UserAccessToken struct {
+	Id       string `gorm:"primaryKey"`
+	Subject  string
+	Provider string
+	Name     string
+	// see middleware.HashAccessToken, the token itself is not stored
+	TokenHash string `gorm:"uniqueIndex"`
+	// comma separated, see middleware.TOKEN_SCOPES
+	Scopes string
+	// empty if the token never expires
+	ExpireTime   string
+	LastUsedTime string
+	CreateTime   string
+}
+
+// UserPublicKey is an ssh key a user pushes and pulls with, a key belongs to one user only.
+type UserPublicKey struct {
+	// SHA256 fingerprint, e.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s
+	Fingerprint string `gorm:"primaryKey"`
+	Subject     string
+	Provider    string
+	Name        string
+	// in authorized_keys format
+	Content    string
+	CreateTime string
+}
+
 type Repository struct {
 	RepositoryId        string `gorm:"primaryKey"`
 	Subject             string
@@ -45,6 +126,30 @@ type Repository struct {
 	Startpoint          string
 	Stage               int32
 	TotalStages         int32
+	AutoTest            bool `gorm:"default:true"`
 	CreateTime          string
 	UpdateTime          string
+	// empty unless archived, an archived repository is read-only
+	ArchiveTime string
+	// empty unless deleted, a deleted repository is purged after RepositoryStorage.DeleteGracePeriodInDay
+	DeleteTime string
+}
+
+// RepositoryEvent is an entry of the audit trail of a repository, such as a reset.
+type RepositoryEvent struct {
+	RepositoryId string `gorm:"primaryKey"`
+	Serial       int32  `gorm:"primaryKey"`
+	Action       string
+	// user who did it
+	Subject        string
+	Provider       string
+	FromStartpoint string
+	ToStartpoint   string
+	FromStage      int32
+	ToStage        int32
+	// HEAD before and after, empty if the action did not touch the files
+	FromCommit  string
+	ToCommit    string
+	KeepHistory bool
+	CreateTime  string
 }
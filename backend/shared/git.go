@@ -1,10 +1,17 @@
 package shared
 
 import (
+	"errors"
 	"judge/jConfig"
 	"judge/router"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -37,3 +44,93 @@ func ProcessGitServerRequestPath(
 
 	return provider, subject, challengeFolderName, repoId, path[len(prefix):], nil
 }
+
+var ErrCommitNotFound = errors.New("commit not found")
+
+// resolveCommitObject finds the commit of a revision, HEAD if the revision is empty.
+func resolveCommitObject(repo *git.Repository, revision string) (*object.Commit, error) {
+	if revision == "" {
+		revision = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+	commitObject, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+	return commitObject, nil
+}
+
+// ResolveCommit returns the full hash of a revision, HEAD if the revision is empty.
+func ResolveCommit(repositoryPath string, revision string) (string, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return "", err
+	}
+	commitObject, err := resolveCommitObject(repo, revision)
+	if err != nil {
+		return "", err
+	}
+	return commitObject.Hash.String(), nil
+}
+
+// ExportCommit writes the files of a commit into destination, leaving the working tree alone.
+func ExportCommit(repositoryPath string, commit string, destination string) error {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return err
+	}
+	commitObject, err := repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return ErrCommitNotFound
+	}
+	files, err := commitObject.Files()
+	if err != nil {
+		return err
+	}
+	return files.ForEach(func(f *object.File) error {
+		path := filepath.Join(destination, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		if f.Mode == filemode.Symlink {
+			return os.Symlink(content, path)
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(content), mode.Perm())
+	})
+}
+
+// ListBranches returns the commit hash of every branch, and the branch HEAD points at.
+func ListBranches(repositoryPath string) (map[string]string, string, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return nil, "", err
+	}
+	branches := make(map[string]string)
+	iter, err := repo.Branches()
+	if err != nil {
+		return nil, "", err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		branches[ref.Name().String()] = ref.Hash().String()
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return branches, head.Target().String(), nil
+}
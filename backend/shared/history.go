@@ -0,0 +1,280 @@
+package shared
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// MAX_BLOB_CONTENT_SIZE is the largest file whose content is returned, larger ones only report their size.
+const MAX_BLOB_CONTENT_SIZE = 1 << 20
+
+const (
+	TREE_ENTRY_TYPE_BLOB      = "blob"
+	TREE_ENTRY_TYPE_TREE      = "tree"
+	TREE_ENTRY_TYPE_SUBMODULE = "submodule"
+)
+
+var ErrPathNotFound = errors.New("path not found")
+
+type Commit struct {
+	Hash          string
+	Message       string
+	AuthorName    string
+	AuthorEmail   string
+	AuthorTime    string
+	CommitterTime string
+	Parents       []string
+}
+
+type TreeEntry struct {
+	Name string
+	Path string
+	Type string
+	Mode string
+	Hash string
+	// 0 for trees and submodules
+	Size int32
+}
+
+type Blob struct {
+	Path   string
+	Hash   string
+	Size   int32
+	Binary bool
+	// nil for binary files and files larger than MAX_BLOB_CONTENT_SIZE
+	Content *string
+}
+
+type FileDiff struct {
+	// empty for added files
+	FromPath string
+	// empty for deleted files
+	ToPath    string
+	Binary    bool
+	Additions int32
+	Deletions int32
+	// in unified format, empty for binary files
+	Patch string
+}
+
+func buildCommit(commitObject *object.Commit) Commit {
+	parents := make([]string, 0, len(commitObject.ParentHashes))
+	for _, parent := range commitObject.ParentHashes {
+		parents = append(parents, parent.String())
+	}
+	return Commit{
+		Hash:          commitObject.Hash.String(),
+		Message:       commitObject.Message,
+		AuthorName:    commitObject.Author.Name,
+		AuthorEmail:   commitObject.Author.Email,
+		AuthorTime:    commitObject.Author.When.Format(time.RFC3339),
+		CommitterTime: commitObject.Committer.When.Format(time.RFC3339),
+		Parents:       parents,
+	}
+}
+
+func clampSize(size int64) int32 {
+	return int32(min(size, math.MaxInt32))
+}
+
+// ListCommits lists up to first commits reachable from revision, newest first,
+// starting after the commit after if it is given. It also tells if there are more.
+// A repository without commits has none.
+func ListCommits(repositoryPath string, revision string, after string, first int) ([]Commit, bool, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return nil, false, err
+	}
+	commitObject, err := resolveCommitObject(repo, revision)
+	if errors.Is(err, ErrCommitNotFound) && revision == "" {
+		return []Commit{}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	iter, err := repo.Log(&git.LogOptions{From: commitObject.Hash, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, false, err
+	}
+	defer iter.Close()
+	commits := make([]Commit, 0, first)
+	hasNextPage := false
+	skipping := after != ""
+	err = iter.ForEach(func(c *object.Commit) error {
+		if skipping {
+			skipping = c.Hash.String() != after
+			return nil
+		}
+		if len(commits) == first {
+			hasNextPage = true
+			return storer.ErrStop
+		}
+		commits = append(commits, buildCommit(c))
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if skipping {
+		return nil, false, ErrCommitNotFound
+	}
+	return commits, hasNextPage, nil
+}
+
+// ListTree lists the folder at path in the commit of revision, the root if path is empty.
+func ListTree(repositoryPath string, revision string, path string) ([]TreeEntry, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	commitObject, err := resolveCommitObject(repo, revision)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commitObject.Tree()
+	if err != nil {
+		return nil, err
+	}
+	path = strings.Trim(path, "/")
+	if path != "" {
+		tree, err = tree.Tree(path)
+		if err != nil {
+			return nil, ErrPathNotFound
+		}
+	}
+	entries := make([]TreeEntry, 0, len(tree.Entries))
+	for _, entry := range tree.Entries {
+		treeEntry := TreeEntry{
+			Name: entry.Name,
+			Path: strings.TrimPrefix(path+"/"+entry.Name, "/"),
+			Mode: entry.Mode.String(),
+			Hash: entry.Hash.String(),
+		}
+		switch entry.Mode {
+		case filemode.Dir:
+			treeEntry.Type = TREE_ENTRY_TYPE_TREE
+		case filemode.Submodule:
+			treeEntry.Type = TREE_ENTRY_TYPE_SUBMODULE
+		default:
+			treeEntry.Type = TREE_ENTRY_TYPE_BLOB
+			blob, err := repo.BlobObject(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			treeEntry.Size = clampSize(blob.Size)
+		}
+		entries = append(entries, treeEntry)
+	}
+	return entries, nil
+}
+
+// ReadBlob reads the file at path in the commit of revision.
+func ReadBlob(repositoryPath string, revision string, path string) (*Blob, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	commitObject, err := resolveCommitObject(repo, revision)
+	if err != nil {
+		return nil, err
+	}
+	file, err := commitObject.File(strings.Trim(path, "/"))
+	if err != nil {
+		return nil, ErrPathNotFound
+	}
+	blob := &Blob{
+		Path: file.Name,
+		Hash: file.Hash.String(),
+		Size: clampSize(file.Size),
+	}
+	blob.Binary, err = file.IsBinary()
+	if err != nil {
+		return nil, err
+	}
+	if blob.Binary || file.Size > MAX_BLOB_CONTENT_SIZE {
+		return blob, nil
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	blob.Content = &content
+	return blob, nil
+}
+
+// singleFilePatch lets the unified encoder write the patch of one file.
+type singleFilePatch struct {
+	filePatch diff.FilePatch
+}
+
+func (p singleFilePatch) FilePatches() []diff.FilePatch {
+	return []diff.FilePatch{p.filePatch}
+}
+
+func (p singleFilePatch) Message() string {
+	return ""
+}
+
+func countLines(content string) int32 {
+	lines := strings.Count(content, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return int32(lines)
+}
+
+// DiffCommits compares the commits of two revisions file by file, to defaults to HEAD.
+func DiffCommits(repositoryPath string, from string, to string) ([]FileDiff, error) {
+	repo, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	fromCommit, err := resolveCommitObject(repo, from)
+	if err != nil {
+		return nil, err
+	}
+	toCommit, err := resolveCommitObject(repo, to)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := fromCommit.Patch(toCommit)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]FileDiff, 0, len(patch.FilePatches()))
+	for _, filePatch := range patch.FilePatches() {
+		fromFile, toFile := filePatch.Files()
+		fileDiff := FileDiff{Binary: filePatch.IsBinary()}
+		if fromFile != nil {
+			fileDiff.FromPath = fromFile.Path()
+		}
+		if toFile != nil {
+			fileDiff.ToPath = toFile.Path()
+		}
+		for _, chunk := range filePatch.Chunks() {
+			switch chunk.Type() {
+			case diff.Add:
+				fileDiff.Additions += countLines(chunk.Content())
+			case diff.Delete:
+				fileDiff.Deletions += countLines(chunk.Content())
+			}
+		}
+		if !fileDiff.Binary {
+			var text strings.Builder
+			if err := diff.NewUnifiedEncoder(&text, diff.DefaultContextLines).Encode(singleFilePatch{filePatch}); err != nil {
+				return nil, err
+			}
+			fileDiff.Patch = text.String()
+		}
+		diffs = append(diffs, fileDiff)
+	}
+	return diffs, nil
+}
@@ -0,0 +1,106 @@
+package tester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"judge/schema"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var ErrTestingNotCancellable = errors.New("testing is neither pending nor running")
+
+// runningTasks lets a cancel request reach a task running in this process immediately.
+// Tasks running elsewhere notice the cancelled status on their next heartbeat.
+var runningTasks = struct {
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+}{
+	cancels: make(map[string]context.CancelFunc),
+}
+
+func runningTaskKey(repositoryId string, serial int32) string {
+	return fmt.Sprintf("%s/%d", repositoryId, serial)
+}
+
+func registerRunningTask(record *schema.Testing, cancel context.CancelFunc) {
+	runningTasks.mutex.Lock()
+	defer runningTasks.mutex.Unlock()
+	runningTasks.cancels[runningTaskKey(record.RepositoryId, record.Serial)] = cancel
+}
+
+func unregisterRunningTask(record *schema.Testing) {
+	runningTasks.mutex.Lock()
+	defer runningTasks.mutex.Unlock()
+	delete(runningTasks.cancels, runningTaskKey(record.RepositoryId, record.Serial))
+}
+
+func cancelRunningTask(repositoryId string, serial int32) bool {
+	runningTasks.mutex.Lock()
+	defer runningTasks.mutex.Unlock()
+	cancel, ok := runningTasks.cancels[runningTaskKey(repositoryId, serial)]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// CancelTesting drops a pending testing from the queue, or stops a running one.
+// The caller is responsible for checking that the repository belongs to the user.
+func CancelTesting(
+	logger *zap.Logger,
+	db *gorm.DB,
+	repositoryId string,
+	serial int32,
+) (*schema.Testing, error) {
+	var record schema.Testing
+	if err := db.Where("repository_id = ? AND serial = ?", repositoryId, serial).First(&record).Error; err != nil {
+		return nil, err
+	}
+	if record.Status != StatusPending && record.Status != StatusRunning {
+		return nil, ErrTestingNotCancellable
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	// the status may change under us, e.g. the pending task just got claimed
+	result := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND serial = ? AND status IN ?", repositoryId, serial, []string{StatusPending, StatusRunning}).
+		Updates(map[string]interface{}{
+			"status":       StatusCancelled,
+			"run_end_time": now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrTestingNotCancellable
+	}
+
+	if cancelRunningTask(repositoryId, serial) {
+		logger.Info("Cancelled running task", zap.String("repository_id", repositoryId), zap.Int32("serial", serial))
+	} else {
+		// the task may be running on a remote worker, which notices on its next heartbeat
+		closeLiveLog(&record)
+		logger.Info("Cancelled task", zap.String("repository_id", repositoryId), zap.Int32("serial", serial))
+	}
+	record.Status = StatusCancelled
+	record.RunEndTime = now
+	return &record, nil
+}
+
+// isTestingCancelled is used by the heartbeat to notice cancellations made through another process.
+func isTestingCancelled(db *gorm.DB, record *schema.Testing) (bool, error) {
+	var status string
+	err := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND serial = ?", record.RepositoryId, record.Serial).
+		Select("status").
+		Scan(&status).Error
+	if err != nil {
+		return false, err
+	}
+	return status == StatusCancelled, nil
+}
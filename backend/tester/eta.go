@@ -0,0 +1,191 @@
+package tester
+
+import (
+	"judge/jConfig"
+	"judge/router"
+	"judge/schema"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// RECENT_RUN_COUNT is how many finished testings the average run duration is taken over.
+const RECENT_RUN_COUNT = 20
+
+// LAST_POSITION orders after every start time, so a simulated user goes to the back of the round.
+const LAST_POSITION = "\uffff"
+
+// QueueStatus is a snapshot of the queue as seen by one testing.
+// Position, TasksAhead and EstimatedStartTime are only set while the testing is pending,
+// EstimatedStartTime also needs at least one finished testing to estimate from.
+// TotalWorkers counts the local workers and those of the remote workers seen within the lease timeout.
+type QueueStatus struct {
+	Position                   *int32  `json:"position"`
+	TasksAhead                 *int32  `json:"tasksAhead"`
+	EstimatedStartTime         *string `json:"estimatedStartTime"`
+	Pending                    int32   `json:"pending"`
+	BusyWorkers                int32   `json:"busyWorkers"`
+	TotalWorkers               int32   `json:"totalWorkers"`
+	AverageRunDurationInSecond int32   `json:"averageRunDurationInSecond"`
+}
+
+// simulateQueuePosition replays the round-robin scheduler over the pending tasks,
+// ignoring the running cap, and returns how many tasks are picked before the given one.
+func simulateQueuePosition(
+	candidates []pendingCandidate,
+	loads map[string]*userLoad,
+	repositoryId string,
+	serial int32,
+) (int, bool) {
+	simulated := make(map[string]*userLoad, len(loads))
+	for key, load := range loads {
+		copied := *load
+		simulated[key] = &copied
+	}
+	remaining := append([]pendingCandidate(nil), candidates...)
+	config := &jConfig.JudgeConfig{}
+	for ahead := 0; len(remaining) > 0; ahead++ {
+		picked := pickNextCandidate(config, remaining, simulated)
+		if picked.RepositoryId == repositoryId && picked.Serial == serial {
+			return ahead, true
+		}
+		key := userKey(picked.Provider, picked.Subject)
+		if simulated[key] == nil {
+			simulated[key] = &userLoad{Provider: picked.Provider, Subject: picked.Subject}
+		}
+		simulated[key].Running++
+		simulated[key].LastRunStart = LAST_POSITION
+		for idx := range remaining {
+			if remaining[idx].RepositoryId == picked.RepositoryId && remaining[idx].Serial == picked.Serial {
+				remaining = append(remaining[:idx], remaining[idx+1:]...)
+				break
+			}
+		}
+	}
+	return 0, false
+}
+
+// averageRunDuration is zero if nothing finished yet.
+func averageRunDuration(db *gorm.DB) (time.Duration, error) {
+	var recent []schema.Testing
+	err := db.Select("run_start_time, run_end_time").
+		Where("status IN ? AND run_start_time <> '' AND run_end_time <> ''", []string{StatusSuccess, StatusFailed}).
+		Order("run_end_time DESC").
+		Limit(RECENT_RUN_COUNT).
+		Find(&recent).Error
+	if err != nil {
+		return 0, err
+	}
+	var total time.Duration
+	var count int64
+	for _, record := range recent {
+		start, err := time.Parse(time.RFC3339, record.RunStartTime)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(time.RFC3339, record.RunEndTime)
+		if err != nil || end.Before(start) {
+			continue
+		}
+		total += end.Sub(start)
+		count++
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return total / time.Duration(count), nil
+}
+
+// estimateWaves counts the runs a worker finishes before a task with tasksAhead before it starts,
+// every worker takes one task at a time, each taking the average duration.
+func estimateWaves(busyWorkers int32, tasksAhead int32, totalWorkers int32) int32 {
+	occupied := busyWorkers + tasksAhead
+	if occupied < totalWorkers {
+		return 0
+	}
+	return (occupied-totalWorkers)/totalWorkers + 1
+}
+
+func GetQueueStatus(
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	record *schema.Testing,
+) (*QueueStatus, error) {
+	candidates, err := listPendingCandidates(db)
+	if err != nil {
+		return nil, err
+	}
+	loads, err := listUserLoads(db)
+	if err != nil {
+		return nil, err
+	}
+	average, err := averageRunDuration(db)
+	if err != nil {
+		return nil, err
+	}
+	status := &QueueStatus{
+		Pending:                    int32(len(candidates)),
+		TotalWorkers:               int32(config.Testing.MaxConcurrentWorkers + remoteWorkerCapacity(config)),
+		AverageRunDurationInSecond: int32(average.Seconds()),
+	}
+	for _, load := range loads {
+		status.BusyWorkers += int32(load.Running)
+	}
+	if record.Status != StatusPending {
+		return status, nil
+	}
+
+	ahead, found := simulateQueuePosition(candidates, loads, record.RepositoryId, record.Serial)
+	if !found {
+		return status, nil
+	}
+	position := int32(ahead + 1)
+	tasksAhead := int32(ahead)
+	status.Position = &position
+	status.TasksAhead = &tasksAhead
+	if average == 0 || status.TotalWorkers <= 0 {
+		return status, nil
+	}
+	waves := estimateWaves(status.BusyWorkers, tasksAhead, status.TotalWorkers)
+	estimatedStartTime := time.Now().Add(time.Duration(waves) * average).Format(time.RFC3339)
+	status.EstimatedStartTime = &estimatedStartTime
+	return status, nil
+}
+
+func BuildQueueStatusHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		repositoryId := c.Params("repo")
+		serial, err := c.ParamsInt("serial", -1)
+		if err != nil || serial < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Invalid serial",
+			))
+		}
+
+		_, ferr := findOwnedRepository(logger, db, c, repositoryId)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+
+		var testingRecord schema.Testing
+		if err := db.Where("repository_id = ? AND serial = ?", repositoryId, serial).First(&testingRecord).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Testing not found",
+			))
+		}
+		status, err := GetQueueStatus(config, db, &testingRecord)
+		if err != nil {
+			logger.Error("Failed to get queue status", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to get queue status",
+			))
+		}
+		return c.Status(fiber.StatusOK).JSON(router.BuildResponse(status))
+	}
+}
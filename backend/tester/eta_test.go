@@ -0,0 +1,79 @@
+package tester
+
+import (
+	"judge/jConfig"
+	"judge/schema"
+	"testing"
+	"time"
+)
+
+func TestEstimateWaves(t *testing.T) {
+	tests := []struct {
+		name         string
+		busyWorkers  int32
+		tasksAhead   int32
+		totalWorkers int32
+		want         int32
+	}{
+		{name: "idle worker", busyWorkers: 0, tasksAhead: 0, totalWorkers: 1, want: 0},
+		{name: "free worker behind others", busyWorkers: 1, tasksAhead: 1, totalWorkers: 3, want: 0},
+		{name: "every worker busy", busyWorkers: 2, tasksAhead: 0, totalWorkers: 2, want: 1},
+		{name: "one task ahead of the last slot", busyWorkers: 2, tasksAhead: 1, totalWorkers: 2, want: 1},
+		{name: "full second wave", busyWorkers: 2, tasksAhead: 2, totalWorkers: 2, want: 2},
+		{name: "single worker", busyWorkers: 1, tasksAhead: 3, totalWorkers: 1, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateWaves(tt.busyWorkers, tt.tasksAhead, tt.totalWorkers); got != tt.want {
+				t.Errorf("estimateWaves(%d, %d, %d) = %d, want %d",
+					tt.busyWorkers, tt.tasksAhead, tt.totalWorkers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetQueueStatusCountsRemoteWorkers(t *testing.T) {
+	db := newTestDB(t)
+	config := &jConfig.JudgeConfig{}
+	start := time.Now().Add(-2 * time.Minute)
+	db.Create(&schema.Testing{
+		RepositoryId: "done", Serial: 1, Status: StatusSuccess,
+		RunStartTime: start.Format(time.RFC3339), RunEndTime: start.Add(time.Minute).Format(time.RFC3339),
+	})
+	db.Create(&schema.Repository{RepositoryId: "busy", Provider: "provider", Subject: "busy"})
+	db.Create(&schema.Repository{RepositoryId: "waiting", Provider: "provider", Subject: "waiting"})
+	db.Create(&schema.Testing{RepositoryId: "busy", Serial: 1, Status: StatusRunning, LeaseOwner: "remote"})
+	record := &schema.Testing{RepositoryId: "waiting", Serial: 1, Status: StatusPending}
+	db.Create(record)
+
+	remoteWorkers.Lock()
+	remoteWorkers.owners = make(map[string]*remoteWorker)
+	remoteWorkers.Unlock()
+	status, err := GetQueueStatus(config, db, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.EstimatedStartTime != nil {
+		t.Errorf("estimated a start time without any worker")
+	}
+
+	// a remote-only setup, the worker runs two tasks at a time
+	seeRemoteWorker("remote", 2)
+	status, err = GetQueueStatus(config, db, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TotalWorkers != 2 || status.BusyWorkers != 1 {
+		t.Errorf("workers = %d busy of %d, want 1 of 2", status.BusyWorkers, status.TotalWorkers)
+	}
+	if status.EstimatedStartTime == nil {
+		t.Fatal("no estimated start time with a remote worker")
+	}
+	estimated, err := time.Parse(time.RFC3339, *status.EstimatedStartTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimated.After(time.Now().Add(time.Second)) {
+		t.Errorf("estimated start %v, want now as a slot of the worker is free", estimated)
+	}
+}
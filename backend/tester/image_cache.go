@@ -0,0 +1,157 @@
+package tester
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"judge/challenge"
+	"judge/jConfig"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"go.uber.org/zap"
+)
+
+// CACHE_IMAGE_LABEL marks the images kept by the image cache.
+const CACHE_IMAGE_LABEL = "judge.cache"
+const CACHE_IMAGE_PREFIX = "judge-cache"
+const CACHE_KEY_LENGTH = 16
+
+var invalidImageNameCharacters = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// buildCacheImage names the cached image of a build.
+// Builds of the same startpoint with the same dockerfile and dependency files share it,
+// so installing the dependencies is only done again once one of them changes.
+func buildCacheImage(
+	challengeRecord *challenge.Challenge,
+	startpoint *challenge.StartPoint,
+	sourcePath string,
+) (string, error) {
+	hash := sha256.New()
+	files := append([]string{startpoint.Dockerfile}, startpoint.DependencyFiles...)
+	for _, file := range files {
+		content, err := os.Open(filepath.Join(sourcePath, file))
+		if os.IsNotExist(err) {
+			fmt.Fprintf(hash, "%s\x00missing\x00", file)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00", file)
+		_, err = io.Copy(hash, content)
+		content.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	repository := strings.ToLower(fmt.Sprintf("%s-%s-%s", CACHE_IMAGE_PREFIX, challengeRecord.FolderName, startpoint.Name))
+	repository = invalidImageNameCharacters.ReplaceAllString(repository, "-")
+	key := hex.EncodeToString(hash.Sum(nil))[:CACHE_KEY_LENGTH]
+	return fmt.Sprintf("%s:%s", repository, key), nil
+}
+
+// imageCache evicts cached images least recently used first.
+type imageCache struct {
+	logger   *zap.Logger
+	config   jConfig.ImageCacheConfig
+	mutex    sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func newImageCache(logger *zap.Logger, config jConfig.ImageCacheConfig) *imageCache {
+	return &imageCache{
+		logger:   logger,
+		config:   config,
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+func (c *imageCache) touch(tag string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastUsed[tag] = time.Now()
+}
+
+type cachedImage struct {
+	tag      string
+	size     int64
+	lastUsed time.Time
+}
+
+// imageStore is the part of the docker client the cache needs.
+type imageStore interface {
+	ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error)
+	ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error)
+}
+
+// evict removes cached images until both budgets are met, keeping the image in use.
+// Images cached before a restart count as used when they were created.
+func (c *imageCache) evict(ctx context.Context, docker imageStore, inUse string) error {
+	if c.config.MaxImages <= 0 && c.config.MaxSizeInMegabytes <= 0 {
+		return nil
+	}
+	summaries, err := docker.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", CACHE_IMAGE_LABEL)),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	images := make([]cachedImage, 0, len(summaries))
+	var totalSize int64
+	for _, summary := range summaries {
+		for _, tag := range summary.RepoTags {
+			if !strings.HasPrefix(tag, CACHE_IMAGE_PREFIX) {
+				continue
+			}
+			lastUsed, ok := c.lastUsed[tag]
+			if !ok {
+				lastUsed = time.Unix(summary.Created, 0)
+			}
+			images = append(images, cachedImage{tag: tag, size: summary.Size, lastUsed: lastUsed})
+			// layers shared between images are counted more than once, which errs on the safe side
+			totalSize += summary.Size
+		}
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].lastUsed.Before(images[j].lastUsed)
+	})
+	count := len(images)
+	overBudget := func() bool {
+		return (c.config.MaxImages > 0 && count > c.config.MaxImages) ||
+			(c.config.MaxSizeInMegabytes > 0 && totalSize > c.config.MaxSizeInMegabytes*MEGABYTE)
+	}
+	for _, cached := range images {
+		if !overBudget() {
+			break
+		}
+		if cached.tag == inUse {
+			continue
+		}
+		// only untags if a running build still uses the image
+		if _, err := docker.ImageRemove(ctx, cached.tag, image.RemoveOptions{}); err != nil {
+			c.logger.Warn("Failed to evict cached image", zap.String("image", cached.tag), zap.Error(err))
+			continue
+		}
+		c.logger.Debug("Evicted cached image", zap.String("image", cached.tag))
+		c.mutex.Lock()
+		delete(c.lastUsed, cached.tag)
+		c.mutex.Unlock()
+		count--
+		totalSize -= cached.size
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package tester
+
+import (
+	"context"
+	"judge/challenge"
+	"judge/jConfig"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"go.uber.org/zap"
+)
+
+func TestBuildCacheImage(t *testing.T) {
+	original := map[string]string{
+		"dockerfile": "FROM golang\nCOPY go.mod go.sum ./\nRUN go mod download\n",
+		"go.mod":     "module hello\n",
+		"go.sum":     "",
+		"main.go":    "package main\n",
+	}
+	tests := []struct {
+		name     string
+		change   map[string]string
+		remove   string
+		wantSame bool
+	}{
+		{name: "same files", wantSame: true},
+		{name: "unrelated file changed", change: map[string]string{"main.go": "package main\n\nfunc main() {}\n"}, wantSame: true},
+		{name: "unrelated file added", change: map[string]string{"util.go": "package main\n"}, wantSame: true},
+		{name: "dependency file changed", change: map[string]string{"go.mod": "module hello\n\ngo 1.23\n"}, wantSame: false},
+		{name: "dependency file removed", remove: "go.sum", wantSame: false},
+		{name: "dockerfile changed", change: map[string]string{"dockerfile": "FROM golang:1.23\n"}, wantSame: false},
+	}
+	challengeRecord := &challenge.Challenge{FolderName: "Hello World"}
+	startpoint := &challenge.StartPoint{Name: "go", Dockerfile: "dockerfile", DependencyFiles: []string{"go.mod", "go.sum"}}
+	writeSource := func(t *testing.T, files map[string]string) string {
+		sourcePath := t.TempDir()
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(sourcePath, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sourcePath
+	}
+	want, err := buildCacheImage(challengeRecord, startpoint, writeSource(t, original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(map[string]string)
+			for name, content := range original {
+				files[name] = content
+			}
+			for name, content := range tt.change {
+				files[name] = content
+			}
+			delete(files, tt.remove)
+			got, err := buildCacheImage(challengeRecord, startpoint, writeSource(t, files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.wantSame {
+				t.Errorf("image %s, first build %s, want same = %v", got, want, tt.wantSame)
+			}
+		})
+	}
+	if !strings.HasPrefix(want, CACHE_IMAGE_PREFIX+"-hello-world-go:") {
+		t.Errorf("image name %s is not a valid docker reference", want)
+	}
+}
+
+// fakeImageStore lists the images it holds and records the removed ones.
+type fakeImageStore struct {
+	images  []image.Summary
+	removed []string
+}
+
+func (s *fakeImageStore) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	return s.images, nil
+}
+
+func (s *fakeImageStore) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	s.removed = append(s.removed, imageID)
+	return nil, nil
+}
+
+func TestImageCacheEvict(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Unix()
+	newStore := func() *fakeImageStore {
+		return &fakeImageStore{images: []image.Summary{
+			{RepoTags: []string{"judge-cache-a:1"}, Created: created, Size: MEGABYTE},
+			{RepoTags: []string{"judge-cache-b:1"}, Created: created + 1, Size: MEGABYTE},
+			{RepoTags: []string{"judge-cache-c:1"}, Created: created + 2, Size: MEGABYTE},
+			{RepoTags: []string{"judge-cache-d:1"}, Created: created + 3, Size: MEGABYTE},
+		}}
+	}
+	tests := []struct {
+		name        string
+		config      jConfig.ImageCacheConfig
+		touched     []string
+		inUse       string
+		wantRemoved []string
+	}{
+		{
+			name:        "oldest first without uses",
+			config:      jConfig.ImageCacheConfig{MaxImages: 2},
+			wantRemoved: []string{"judge-cache-a:1", "judge-cache-b:1"},
+		},
+		{
+			name:        "recently used images are kept",
+			config:      jConfig.ImageCacheConfig{MaxImages: 2},
+			touched:     []string{"judge-cache-b:1", "judge-cache-a:1"},
+			wantRemoved: []string{"judge-cache-c:1", "judge-cache-d:1"},
+		},
+		{
+			name:        "the image in use is never removed",
+			config:      jConfig.ImageCacheConfig{MaxImages: 3},
+			inUse:       "judge-cache-a:1",
+			wantRemoved: []string{"judge-cache-b:1"},
+		},
+		{
+			name:        "size budget",
+			config:      jConfig.ImageCacheConfig{MaxSizeInMegabytes: 3},
+			touched:     []string{"judge-cache-a:1"},
+			wantRemoved: []string{"judge-cache-b:1"},
+		},
+		{
+			name:   "within budget",
+			config: jConfig.ImageCacheConfig{MaxImages: 4, MaxSizeInMegabytes: 4},
+		},
+		{
+			name: "no budget",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newImageCache(zap.NewNop(), tt.config)
+			for _, tag := range tt.touched {
+				cache.touch(tag)
+				time.Sleep(time.Millisecond)
+			}
+			store := newStore()
+			if err := cache.evict(context.Background(), store, tt.inUse); err != nil {
+				t.Fatal(err)
+			}
+			if len(store.removed) == 0 && len(tt.wantRemoved) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(store.removed, tt.wantRemoved) {
+				t.Errorf("removed %v, want %v", store.removed, tt.wantRemoved)
+			}
+		})
+	}
+}
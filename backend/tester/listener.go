@@ -1,40 +1,108 @@
 package tester
 
 import (
+	"context"
+	"errors"
 	"judge/jConfig"
 	"time"
 
-	"github.com/docker/docker/client"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
+func runClaimedTask(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	sandbox Sandbox,
+	task *TestingTask,
+	owner string,
+) {
+	// closed last, so stream subscribers see the final status
+	task.LiveLog = openLiveLog(task.TestingRecord)
+	defer closeLiveLog(task.TestingRecord)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerRunningTask(task.TestingRecord, cancel)
+	defer unregisterRunningTask(task.TestingRecord)
+	stopHeartbeat := startHeartbeat(logger, config, db, task.TestingRecord, owner, cancel)
+	defer releaseLease(logger, db, task.TestingRecord, owner)
+	defer stopHeartbeat()
+
+	err := runTask(ctx, logger, config, db, sandbox, task)
+	if errors.Is(err, ErrTestingDropped) {
+		logger.Info("Task cancelled before it started", zap.String("repository_id", task.RepositoryId), zap.Int("serial", task.Serial))
+		return
+	}
+	if ctx.Err() != nil {
+		logger.Info("Task cancelled", zap.String("repository_id", task.RepositoryId), zap.Int("serial", task.Serial))
+		task.TestingRecord.Status = StatusCancelled
+		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
+		// usually the row is cancelled already, and this is dropped
+		if err := saveTestingRecord(db, task.TestingRecord); err != nil && !errors.Is(err, ErrTestingDropped) {
+			logger.Error("Failed to update task status", zap.Error(err))
+		}
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to run task", zap.Error(err))
+		task.TestingRecord.Status = StatusError
+		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
+		// update the task status, unless it was cancelled or reclaimed meanwhile
+		if err := saveTestingRecord(db, task.TestingRecord); err != nil && !errors.Is(err, ErrTestingDropped) {
+			logger.Error("Failed to update task status", zap.Error(err))
+		}
+	}
+}
+
 func StartListener(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
 	db *gorm.DB,
-	docker *client.Client,
+	sandbox Sandbox,
 ) {
 	queue := GetTestingQueue(config)
+	owner := newLeaseOwner()
+	logger.Info("Testing listener started", zap.String("lease_owner", owner))
+
+	// pick up whatever a previous run of the server left behind
+	if err := reclaimExpiredLeases(logger, config, db); err != nil {
+		logger.Error("Failed to reclaim orphaned tasks", zap.Error(err))
+	}
+
+	go func() {
+		ticker := time.NewTicker(pollInterval(config))
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reclaimExpiredLeases(logger, config, db); err != nil {
+				logger.Error("Failed to reclaim orphaned tasks", zap.Error(err))
+			}
+		}
+	}()
+
 	for {
 		// wait for semaphore
 		<-queue.Semaphore
 		// get task from queue
-		task := <-queue.PendingQueue
-		logger.Info("Got task", zap.String("repository_id", task.RepositoryId), zap.Int("serial", task.Serial), zap.Int("stage", task.Stage))
-		// run task
-		err := runTask(logger, config, db, docker, &task)
+		task, err := claimNextTask(logger, config, db, owner)
 		if err != nil {
-			logger.Error("Failed to run task", zap.Error(err))
-			task.TestingRecord.Status = StatusError
-			task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-			// update the task status
-			if err := db.Save(&task.TestingRecord).Error; err != nil {
-				logger.Error("Failed to update task status", zap.Error(err))
+			logger.Error("Failed to claim task", zap.Error(err))
+		}
+		if task == nil {
+			queue.Semaphore <- true
+			select {
+			case <-queue.Wake:
+			case <-time.After(pollInterval(config)):
 			}
 			continue
 		}
-		// release semaphore
-		queue.Semaphore <- true
+		logger.Info("Got task", zap.String("repository_id", task.RepositoryId), zap.Int("serial", task.Serial), zap.Int("stage", task.Stage))
+		go func() {
+			// release semaphore
+			defer func() { queue.Semaphore <- true }()
+			// tasks held back by the per user cap may run now
+			defer queue.Notify()
+			runClaimedTask(logger, config, db, sandbox, task, owner)
+		}()
 	}
 }
@@ -1,12 +1,33 @@
 package tester
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"judge/challenge"
 	"judge/jConfig"
+	"judge/schema"
+	"math/rand"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	DEFAULT_LEASE_TIMEOUT_IN_SECOND = 60
+	DEFAULT_POLL_INTERVAL_IN_SECOND = 5
 )
 
+// The pending queue itself lives in the testing table, rows with StatusPending are queued.
+// A worker claims a row by moving it to StatusRunning together with a lease,
+// and keeps extending the lease while the task runs.
+// Rows whose lease expired are orphaned, e.g. the server crashed, and are reclaimed.
 type TestingQueue struct {
-	PendingQueue chan TestingTask
-	Semaphore    chan bool
+	Semaphore chan bool
+	// Wake is signalled when a task is pushed, so the listener does not wait for the next poll
+	Wake chan bool
 }
 
 var i *TestingQueue = nil
@@ -14,8 +35,8 @@ var i *TestingQueue = nil
 func GetTestingQueue(config *jConfig.JudgeConfig) *TestingQueue {
 	if i == nil {
 		i = &TestingQueue{
-			PendingQueue: make(chan TestingTask, config.Testing.PendingQueueSize),
-			Semaphore:    make(chan bool, config.Testing.MaxConcurrentWorkers),
+			Semaphore: make(chan bool, config.Testing.MaxConcurrentWorkers),
+			Wake:      make(chan bool, 1),
 		}
 		for idx := 0; idx < config.Testing.MaxConcurrentWorkers; idx++ {
 			i.Semaphore <- true
@@ -23,3 +44,278 @@ func GetTestingQueue(config *jConfig.JudgeConfig) *TestingQueue {
 	}
 	return i
 }
+
+func (q *TestingQueue) Notify() {
+	select {
+	case q.Wake <- true:
+	default:
+	}
+}
+
+var leaseColumns = []string{"LeaseOwner", "LeaseExpireTime"}
+
+// ErrTestingDropped means a leased row was cancelled or reclaimed while its task ran, so its result is dropped.
+var ErrTestingDropped = errors.New("testing was cancelled or reclaimed")
+
+// saveTestingRecord saves an existing record without touching its lease, which is owned by the heartbeat.
+// A leased record is only saved while the row is still running under that lease, otherwise it is ErrTestingDropped.
+func saveTestingRecord(db *gorm.DB, record *schema.Testing) error {
+	tx := db.Model(record).Select("*").Omit(leaseColumns...)
+	if record.LeaseOwner != "" {
+		// a worker that lost its lease must not overwrite the reclaimed row,
+		// and a late result must not overwrite a cancellation
+		tx = tx.Where("lease_owner = ? AND status = ?", record.LeaseOwner, StatusRunning)
+	}
+	result := tx.Updates(record)
+	if result.Error != nil {
+		return result.Error
+	}
+	if record.LeaseOwner != "" && result.RowsAffected == 0 {
+		return ErrTestingDropped
+	}
+	return nil
+}
+
+func newLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+}
+
+func leaseTimeout(config *jConfig.JudgeConfig) time.Duration {
+	if config.Testing.LeaseTimeoutInSecond <= 0 {
+		return DEFAULT_LEASE_TIMEOUT_IN_SECOND * time.Second
+	}
+	return time.Duration(config.Testing.LeaseTimeoutInSecond) * time.Second
+}
+
+func pollInterval(config *jConfig.JudgeConfig) time.Duration {
+	if config.Testing.PollIntervalInSecond <= 0 {
+		return DEFAULT_POLL_INTERVAL_IN_SECOND * time.Second
+	}
+	return time.Duration(config.Testing.PollIntervalInSecond) * time.Second
+}
+
+func countPendingTasks(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Model(&schema.Testing{}).Where("status = ?", StatusPending).Count(&count).Error
+	return count, err
+}
+
+// claimTask moves a pending row to running under the given lease owner.
+// It returns false if another worker got the row first.
+func claimTask(
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	record *schema.Testing,
+	owner string,
+) (bool, error) {
+	expireTime := time.Now().Add(leaseTimeout(config)).Format(time.RFC3339)
+	result := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND serial = ? AND status = ?", record.RepositoryId, record.Serial, StatusPending).
+		Updates(map[string]interface{}{
+			"status":            StatusRunning,
+			"lease_owner":       owner,
+			"lease_expire_time": expireTime,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	record.Status = StatusRunning
+	record.LeaseOwner = owner
+	record.LeaseExpireTime = expireTime
+	return true, nil
+}
+
+// buildTestingTask loads everything runTask needs for a claimed row.
+func buildTestingTask(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	record *schema.Testing,
+) (*TestingTask, error) {
+	repositoryRecord := &schema.Repository{}
+	if err := db.Where("repository_id = ?", record.RepositoryId).First(repositoryRecord).Error; err != nil {
+		logger.Error("Failed to get repository record", zap.Error(err))
+		return nil, err
+	}
+	challengeRecord, err := challenge.GetCatalog(logger, &config.Challenge).Get(repositoryRecord.ChallengeFolderName)
+	if err != nil {
+		logger.Error("Failed to get challenge", zap.Error(err))
+		return nil, err
+	}
+	waitingStartTime, err := time.Parse(time.RFC3339, record.CreateTime)
+	if err != nil {
+		waitingStartTime = time.Now()
+	}
+	return &TestingTask{
+		RepositoryId:     record.RepositoryId,
+		Serial:           int(record.Serial),
+		Stage:            int(record.Stage),
+		Challenge:        *challengeRecord,
+		Repository:       *repositoryRecord,
+		TestingRecord:    record,
+		WaitingStartTime: waitingStartTime,
+	}, nil
+}
+
+// claimNextTask claims the next pending task, see pickNextCandidate.
+// It returns nil if no task may run now.
+func claimNextTask(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	owner string,
+) (*TestingTask, error) {
+	for {
+		candidates, err := listPendingCandidates(db)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		loads, err := listUserLoads(db)
+		if err != nil {
+			return nil, err
+		}
+		candidate := pickNextCandidate(config, candidates, loads)
+		if candidate == nil {
+			return nil, nil
+		}
+		var record schema.Testing
+		// Find instead of First, the row may have been cancelled in the meantime
+		result := db.Where("repository_id = ? AND serial = ?", candidate.RepositoryId, candidate.Serial).Limit(1).Find(&record)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		claimed, err := claimTask(config, db, &record, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			continue
+		}
+		task, err := buildTestingTask(logger, config, db, &record)
+		if err != nil {
+			record.Status = StatusError
+			record.RunEndTime = time.Now().Format(time.RFC3339)
+			if saveErr := saveTestingRecord(db, &record); saveErr != nil && !errors.Is(saveErr, ErrTestingDropped) {
+				logger.Error("Failed to update task status", zap.Error(saveErr))
+			}
+			releaseLease(logger, db, &record, owner)
+			continue
+		}
+		return task, nil
+	}
+}
+
+// startHeartbeat keeps extending the lease of a running task until the returned function is called.
+// It calls cancel once the task got cancelled.
+func startHeartbeat(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	record *schema.Testing,
+	owner string,
+	cancel context.CancelFunc,
+) func() {
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(leaseTimeout(config) / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := db.Model(&schema.Testing{}).
+					Where("repository_id = ? AND serial = ? AND lease_owner = ?", record.RepositoryId, record.Serial, owner).
+					Update("lease_expire_time", time.Now().Add(leaseTimeout(config)).Format(time.RFC3339)).Error
+				if err != nil {
+					logger.Error("Failed to extend lease", zap.Error(err))
+				}
+				cancelled, err := isTestingCancelled(db, record)
+				if err != nil {
+					logger.Error("Failed to check testing status", zap.Error(err))
+				}
+				if cancelled {
+					cancel()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func releaseLease(logger *zap.Logger, db *gorm.DB, record *schema.Testing, owner string) {
+	err := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND serial = ? AND lease_owner = ?", record.RepositoryId, record.Serial, owner).
+		Updates(map[string]interface{}{
+			"lease_owner":       "",
+			"lease_expire_time": "",
+		}).Error
+	if err != nil {
+		logger.Error("Failed to release lease", zap.Error(err))
+	}
+}
+
+// reclaimExpiredLeases handles running tasks whose worker stopped heartbeating.
+// They are either put back into the queue or marked as error, depending on RequeueOrphanedTasks.
+func reclaimExpiredLeases(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) error {
+	var running []schema.Testing
+	if err := db.Where("status = ?", StatusRunning).Find(&running).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, record := range running {
+		expireTime, err := time.Parse(time.RFC3339, record.LeaseExpireTime)
+		if err == nil && expireTime.After(now) {
+			continue
+		}
+		updates := map[string]interface{}{
+			"lease_owner":       "",
+			"lease_expire_time": "",
+		}
+		if config.Testing.RequeueOrphanedTasks {
+			updates["status"] = StatusPending
+			updates["run_start_time"] = ""
+		} else {
+			updates["status"] = StatusError
+			updates["message"] = "The worker running this task stopped unexpectedly."
+			updates["run_end_time"] = now.Format(time.RFC3339)
+		}
+		// only reclaim if nobody extended or released the lease in the meantime
+		result := db.Model(&schema.Testing{}).
+			Where("repository_id = ? AND serial = ? AND status = ? AND lease_owner = ? AND lease_expire_time = ?",
+				record.RepositoryId, record.Serial, StatusRunning, record.LeaseOwner, record.LeaseExpireTime).
+			Updates(updates)
+		if result.Error != nil {
+			logger.Error("Failed to reclaim orphaned task", zap.Error(result.Error))
+			continue
+		}
+		if result.RowsAffected == 1 {
+			// a remote worker streamed into it
+			closeLiveLog(&record)
+			logger.Warn("Reclaimed orphaned task",
+				zap.String("repository_id", record.RepositoryId),
+				zap.Int32("serial", record.Serial),
+				zap.String("lease_owner", record.LeaseOwner),
+				zap.Bool("requeued", config.Testing.RequeueOrphanedTasks),
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package tester
+
+import (
+	"errors"
+	"judge/schema"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSaveTestingRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		// the row in the database when the worker saves
+		status     string
+		leaseOwner string
+		// the lease the worker thinks it holds
+		savedBy    string
+		wantErr    error
+		wantStatus string
+	}{
+		{
+			name:       "running under the lease",
+			status:     StatusRunning,
+			leaseOwner: "worker",
+			savedBy:    "worker",
+			wantStatus: StatusSuccess,
+		},
+		{
+			name:       "cancelled while running",
+			status:     StatusCancelled,
+			leaseOwner: "worker",
+			savedBy:    "worker",
+			wantErr:    ErrTestingDropped,
+			wantStatus: StatusCancelled,
+		},
+		{
+			name:       "reclaimed and requeued",
+			status:     StatusPending,
+			leaseOwner: "",
+			savedBy:    "worker",
+			wantErr:    ErrTestingDropped,
+			wantStatus: StatusPending,
+		},
+		{
+			name:       "reclaimed by another worker",
+			status:     StatusRunning,
+			leaseOwner: "other",
+			savedBy:    "worker",
+			wantErr:    ErrTestingDropped,
+			wantStatus: StatusRunning,
+		},
+		{
+			name:       "record without lease",
+			status:     StatusRunning,
+			leaseOwner: "",
+			savedBy:    "",
+			wantStatus: StatusSuccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			db.Create(&schema.Testing{RepositoryId: "repo", Serial: 1, Status: tt.status, LeaseOwner: tt.leaseOwner})
+
+			record := &schema.Testing{RepositoryId: "repo", Serial: 1, Status: StatusSuccess, LeaseOwner: tt.savedBy}
+			err := saveTestingRecord(db, record)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			var saved schema.Testing
+			db.Where("repository_id = ? AND serial = ?", "repo", 1).First(&saved)
+			if saved.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", saved.Status, tt.wantStatus)
+			}
+			if saved.LeaseOwner != tt.leaseOwner {
+				t.Errorf("lease owner = %q, want it untouched as %q", saved.LeaseOwner, tt.leaseOwner)
+			}
+		})
+	}
+}
+
+func TestRecordTaskOutcomeOfCancelledTesting(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&schema.Repository{RepositoryId: "repo", Stage: 0})
+	db.Create(&schema.Testing{RepositoryId: "repo", Serial: 1, Status: StatusCancelled, LeaseOwner: "worker"})
+
+	task := &TestingTask{
+		RepositoryId:  "repo",
+		Serial:        1,
+		Stage:         0,
+		TestingRecord: &schema.Testing{RepositoryId: "repo", Serial: 1, Status: StatusRunning, LeaseOwner: "worker"},
+	}
+	outcome := &taskOutcome{Results: []*stageResult{{Stage: 0, Status: StatusSuccess, Score: 1, MaxScore: 1}}}
+	if err := recordTaskOutcome(zap.NewNop(), db, task, outcome); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved schema.Testing
+	db.Where("repository_id = ? AND serial = ?", "repo", 1).First(&saved)
+	if saved.Status != StatusCancelled {
+		t.Errorf("status = %q, want it to stay %q", saved.Status, StatusCancelled)
+	}
+	var repositoryRecord schema.Repository
+	db.Where("repository_id = ?", "repo").First(&repositoryRecord)
+	if repositoryRecord.Stage != 0 {
+		t.Errorf("repository advanced to stage %d", repositoryRecord.Stage)
+	}
+	var stages, scores int64
+	db.Model(&schema.TestingStage{}).Count(&stages)
+	db.Model(&schema.RepositoryStageScore{}).Count(&scores)
+	if stages != 0 || scores != 0 {
+		t.Errorf("recorded %d stages and %d scores of a cancelled testing", stages, scores)
+	}
+}
@@ -0,0 +1,285 @@
+package tester
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"judge/schema"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// A test writes its report into the report folder, which is REPORT_DIR in its environment.
+//
+//   - result, optional if a structured report is given.
+//     Starts with "t" if the stage passed and with "f" if it failed.
+//   - message.md, optional if a structured report is given.
+//     Markdown shown to the student.
+//   - report.json, optional structured report, see jsonReport.
+//   - junit.xml, optional structured report in the JUnit XML format.
+//   - score, optional number of points out of the max score of the stage.
+//     Without it a passed stage gets the max score and a failed one nothing.
+//
+// If result is missing, the stage passes when no case in the structured report failed or errored,
+// a structured report without passed and without cases is an error.
+const REPORT_MESSAGE_FILE = "message.md"
+const REPORT_RESULT_FILE = "result"
+const REPORT_SCORE_FILE = "score"
+const REPORT_JSON_FILE = "report.json"
+const REPORT_JUNIT_FILE = "junit.xml"
+
+const (
+	CaseStatusPassed  = "passed"
+	CaseStatusFailed  = "failed"
+	CaseStatusError   = "error"
+	CaseStatusSkipped = "skipped"
+)
+
+var ErrNoReport = errors.New("the test wrote neither a result nor a structured report")
+var ErrEmptyReport = errors.New("the structured report has neither passed nor any case")
+var ErrInvalidScore = errors.New("the score is not a finite number")
+
+// jsonReport is the schema of report.json, for example
+//
+//	{
+//	  "passed": false,
+//	  "score": 5,
+//	  "message": "1 of 2 cases failed",
+//	  "cases": [
+//	    {"name": "test_add", "status": "passed", "duration": 0.01},
+//	    {"name": "test_sub", "status": "failed", "duration": 0.02, "output": "expected 1, got 2"}
+//	  ]
+//	}
+//
+// passed, score and message are optional, duration is in seconds and status is one of
+// passed, failed, error, skipped.
+type jsonReport struct {
+	Passed  *bool    `json:"passed"`
+	Score   *float64 `json:"score"`
+	Message string   `json:"message"`
+	Cases   []struct {
+		Name      string  `json:"name"`
+		ClassName string  `json:"className"`
+		Status    string  `json:"status"`
+		Duration  float64 `json:"duration"`
+		Output    string  `json:"output"`
+	} `json:"cases"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitTestSuite struct {
+	TestCases  []junitTestCase  `xml:"testcase"`
+	TestSuites []junitTestSuite `xml:"testsuite"`
+}
+
+type Report struct {
+	Pass bool
+	// nil if the test did not report one
+	Score   *float64
+	Message string
+	// without RepositoryId and Serial, see saveTestingCases
+	Cases []schema.TestingCase
+}
+
+func parseJsonReport(content []byte) (*jsonReport, []schema.TestingCase, error) {
+	var report jsonReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, nil, err
+	}
+	cases := make([]schema.TestingCase, 0, len(report.Cases))
+	for _, c := range report.Cases {
+		status := strings.ToLower(c.Status)
+		switch status {
+		case CaseStatusPassed, CaseStatusFailed, CaseStatusError, CaseStatusSkipped:
+		default:
+			return nil, nil, fmt.Errorf("case %q has unknown status %q", c.Name, c.Status)
+		}
+		cases = append(cases, schema.TestingCase{
+			Name:                  c.Name,
+			ClassName:             c.ClassName,
+			Status:                status,
+			DurationInMillisecond: int32(c.Duration * 1000),
+			Output:                c.Output,
+		})
+	}
+	return &report, cases, nil
+}
+
+func collectJunitCases(suite *junitTestSuite, cases []schema.TestingCase) []schema.TestingCase {
+	for _, c := range suite.TestCases {
+		testingCase := schema.TestingCase{
+			Name:                  c.Name,
+			ClassName:             c.ClassName,
+			Status:                CaseStatusPassed,
+			DurationInMillisecond: int32(c.Time * 1000),
+			Output:                c.SystemOut,
+		}
+		if c.Skipped != nil {
+			testingCase.Status = CaseStatusSkipped
+		}
+		failure := c.Failure
+		if failure != nil {
+			testingCase.Status = CaseStatusFailed
+		}
+		if c.Error != nil {
+			failure = c.Error
+			testingCase.Status = CaseStatusError
+		}
+		if failure != nil {
+			testingCase.Output = strings.TrimSpace(strings.Join([]string{failure.Message, failure.Text, c.SystemOut}, "\n"))
+		}
+		cases = append(cases, testingCase)
+	}
+	for idx := range suite.TestSuites {
+		cases = collectJunitCases(&suite.TestSuites[idx], cases)
+	}
+	return cases
+}
+
+// parseJunitReport accepts both a <testsuites> and a single <testsuite> root.
+func parseJunitReport(content []byte) ([]schema.TestingCase, error) {
+	var suite junitTestSuite
+	if err := xml.Unmarshal(content, &suite); err != nil {
+		return nil, err
+	}
+	return collectJunitCases(&suite, nil), nil
+}
+
+func casesPassed(cases []schema.TestingCase) bool {
+	for _, c := range cases {
+		if c.Status == CaseStatusFailed || c.Status == CaseStatusError {
+			return false
+		}
+	}
+	return true
+}
+
+func readReport(
+	logger *zap.Logger,
+	reportPath string,
+) (*Report, error) {
+	logger.Debug("Reading report", zap.String("report_path", reportPath))
+	report := &Report{}
+	structured := false
+	var structuredPass *bool
+
+	jsonContent, err := os.ReadFile(filepath.Join(reportPath, REPORT_JSON_FILE))
+	if err == nil {
+		parsed, cases, err := parseJsonReport(jsonContent)
+		if err != nil {
+			logger.Error("Failed to parse json report", zap.Error(err))
+			return nil, err
+		}
+		structured = true
+		structuredPass = parsed.Passed
+		report.Score = parsed.Score
+		report.Message = parsed.Message
+		report.Cases = append(report.Cases, cases...)
+	}
+	junitContent, err := os.ReadFile(filepath.Join(reportPath, REPORT_JUNIT_FILE))
+	if err == nil {
+		cases, err := parseJunitReport(junitContent)
+		if err != nil {
+			logger.Error("Failed to parse junit report", zap.Error(err))
+			return nil, err
+		}
+		structured = true
+		report.Cases = append(report.Cases, cases...)
+	}
+
+	reportScore, err := os.ReadFile(filepath.Join(reportPath, REPORT_SCORE_FILE))
+	if err == nil {
+		score, err := strconv.ParseFloat(strings.TrimSpace(string(reportScore)), 64)
+		if err != nil {
+			logger.Error("Failed to parse report score file", zap.Error(err))
+			return nil, err
+		}
+		// ParseFloat takes inf and nan, which would give the max score
+		if math.IsInf(score, 0) || math.IsNaN(score) {
+			return nil, ErrInvalidScore
+		}
+		report.Score = &score
+	}
+
+	reportMessage, err := os.ReadFile(filepath.Join(reportPath, REPORT_MESSAGE_FILE))
+	if err == nil {
+		report.Message = string(reportMessage)
+	} else if !structured {
+		if _, statErr := os.Stat(filepath.Join(reportPath, REPORT_RESULT_FILE)); statErr != nil {
+			logger.Error("Failed to read report result file", zap.Error(statErr))
+			return nil, ErrNoReport
+		}
+		logger.Error("Failed to read report message file", zap.Error(err))
+		return nil, err
+	}
+
+	reportResult, err := os.ReadFile(filepath.Join(reportPath, REPORT_RESULT_FILE))
+	if err != nil {
+		if !structured {
+			logger.Error("Failed to read report result file", zap.Error(err))
+			return nil, ErrNoReport
+		}
+		if structuredPass != nil {
+			report.Pass = *structuredPass
+			return report, nil
+		}
+		// an empty or truncated report must not pass by having no failed case
+		if len(report.Cases) == 0 {
+			return nil, ErrEmptyReport
+		}
+		report.Pass = casesPassed(report.Cases)
+		return report, nil
+	}
+	if strings.HasPrefix(strings.ToLower(string(reportResult)), "t") {
+		report.Pass = true
+		return report, nil
+	}
+	if strings.HasPrefix(strings.ToLower(string(reportResult)), "f") {
+		report.Pass = false
+		return report, nil
+	}
+	logger.Warn("Unrecognized report result, supposing it failed", zap.String("result", string(reportResult)))
+	report.Pass = false
+	return report, nil
+}
+
+// saveTestingCases replaces the cases stored for a testing.
+func saveTestingCases(db *gorm.DB, record *schema.Testing, cases []schema.TestingCase) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("repository_id = ? AND serial = ?", record.RepositoryId, record.Serial).
+			Delete(&schema.TestingCase{}).Error
+		if err != nil {
+			return err
+		}
+		if len(cases) == 0 {
+			return nil
+		}
+		for idx := range cases {
+			cases[idx].RepositoryId = record.RepositoryId
+			cases[idx].Serial = record.Serial
+			cases[idx].Position = int32(idx)
+		}
+		return tx.Create(&cases).Error
+	})
+}
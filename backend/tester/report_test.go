@@ -0,0 +1,158 @@
+package tester
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestReadReport(t *testing.T) {
+	junit := `<testsuites>
+  <testsuite name="calc">
+    <testcase name="add" classname="calc" time="0.5"/>
+    <testcase name="sub" classname="calc" time="0.25"><failure message="expected 1">got 2</failure></testcase>
+    <testcase name="mul" classname="calc"><skipped/></testcase>
+  </testsuite>
+</testsuites>`
+	tests := []struct {
+		name      string
+		files     map[string]string
+		wantErr   bool
+		wantPass  bool
+		wantScore *float64
+		wantCases int
+		wantMsg   string
+	}{
+		{name: "nothing written", files: map[string]string{}, wantErr: true},
+		{name: "legacy pass", files: map[string]string{"result": "true\n", "message.md": "well done"}, wantPass: true, wantMsg: "well done"},
+		{name: "legacy fail", files: map[string]string{"result": "False", "message.md": "wrong"}, wantPass: false, wantMsg: "wrong"},
+		{name: "legacy without message", files: map[string]string{"result": "true"}, wantErr: true},
+		{name: "legacy message without result", files: map[string]string{"message.md": "hello"}, wantErr: true},
+		{name: "unrecognized result fails", files: map[string]string{"result": "yes", "message.md": ""}, wantPass: false},
+		{name: "empty result fails", files: map[string]string{"result": "", "message.md": ""}, wantPass: false},
+		{
+			name:      "json with cases",
+			files:     map[string]string{"report.json": `{"message": "1 of 2", "cases": [{"name": "a", "status": "passed"}, {"name": "b", "status": "FAILED"}]}`},
+			wantPass:  false,
+			wantCases: 2,
+			wantMsg:   "1 of 2",
+		},
+		{
+			name:      "json passed overrides cases",
+			files:     map[string]string{"report.json": `{"passed": true, "cases": [{"name": "b", "status": "failed"}]}`},
+			wantPass:  true,
+			wantCases: 1,
+		},
+		{name: "json with an unknown status", files: map[string]string{"report.json": `{"cases": [{"name": "a", "status": "ok"}]}`}, wantErr: true},
+		{name: "truncated json", files: map[string]string{"report.json": `{"cases": [{"name": "a", "sta`}, wantErr: true},
+		{name: "json with a wrong type", files: map[string]string{"report.json": `{"passed": "yes"}`}, wantErr: true},
+		{name: "empty json", files: map[string]string{"report.json": `{}`}, wantErr: true},
+		{name: "json with no cases", files: map[string]string{"report.json": `{"cases": []}`}, wantErr: true},
+		{name: "junit", files: map[string]string{"junit.xml": junit}, wantPass: false, wantCases: 3},
+		{name: "single junit suite passing", files: map[string]string{"junit.xml": `<testsuite><testcase name="a"/></testsuite>`}, wantPass: true, wantCases: 1},
+		{name: "junit error", files: map[string]string{"junit.xml": `<testsuite><testcase name="a"><error message="boom"/></testcase></testsuite>`}, wantPass: false, wantCases: 1},
+		{name: "truncated junit", files: map[string]string{"junit.xml": `<testsuites><testsuite><testcase name="a">`}, wantErr: true},
+		{name: "junit without cases", files: map[string]string{"junit.xml": `<testsuites/>`}, wantErr: true},
+		{name: "not junit", files: map[string]string{"junit.xml": `<html><body>oops</body></html>`}, wantErr: true},
+		{
+			name:      "result overrides structured report",
+			files:     map[string]string{"result": "t", "junit.xml": junit},
+			wantPass:  true,
+			wantCases: 3,
+		},
+		{
+			name:      "score file",
+			files:     map[string]string{"result": "f", "message.md": "", "score": " 2.5\n"},
+			wantPass:  false,
+			wantScore: floatPointer(2.5),
+		},
+		{
+			name:      "score file overrides json score",
+			files:     map[string]string{"report.json": `{"passed": true, "score": 10}`, "score": "3"},
+			wantPass:  true,
+			wantScore: floatPointer(3),
+		},
+		{name: "json score", files: map[string]string{"report.json": `{"passed": true, "score": 7}`}, wantPass: true, wantScore: floatPointer(7)},
+		{name: "score not a number", files: map[string]string{"result": "t", "message.md": "", "score": "ten"}, wantErr: true},
+		{name: "infinite score", files: map[string]string{"result": "t", "message.md": "", "score": "inf"}, wantErr: true},
+		{name: "nan score", files: map[string]string{"result": "t", "message.md": "", "score": "NaN"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reportPath := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(reportPath, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := readReport(zap.NewNop(), reportPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("read %+v, want an error", report)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Pass != tt.wantPass {
+				t.Errorf("pass = %v, want %v", report.Pass, tt.wantPass)
+			}
+			if (report.Score == nil) != (tt.wantScore == nil) || (report.Score != nil && *report.Score != *tt.wantScore) {
+				t.Errorf("score = %v, want %v", report.Score, tt.wantScore)
+			}
+			if len(report.Cases) != tt.wantCases {
+				t.Errorf("cases = %d, want %d", len(report.Cases), tt.wantCases)
+			}
+			if report.Message != tt.wantMsg {
+				t.Errorf("message = %q, want %q", report.Message, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func floatPointer(value float64) *float64 {
+	return &value
+}
+
+func TestRunStageWithBadReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr error
+	}{
+		{name: "no report", files: map[string]string{}, wantErr: ErrNoReport},
+		{name: "empty structured report", files: map[string]string{"junit.xml": `<testsuites/>`}, wantErr: ErrEmptyReport},
+		{name: "infinite score", files: map[string]string{"result": "t", "message.md": "", "score": "+Inf"}, wantErr: ErrInvalidScore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sandbox := &FakeSandbox{RunFunc: func(spec *RunSpec) (*RunResult, error) {
+				for name, content := range tt.files {
+					if err := os.WriteFile(filepath.Join(spec.ReportPath, name), []byte(content), 0644); err != nil {
+						return nil, err
+					}
+				}
+				return &RunResult{}, nil
+			}}
+			ctx := context.Background()
+			if _, err := sandbox.Build(ctx, &BuildSpec{ImageName: "image"}); err != nil {
+				t.Fatal(err)
+			}
+			spec := &RunSpec{ImageName: "image", ReportPath: t.TempDir()}
+			result, err := runStage(ctx, zap.NewNop(), sandbox, spec, 0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != StatusError || result.Score != 0 {
+				t.Errorf("status %q with score %g, want %q with none", result.Status, result.Score, StatusError)
+			}
+			if result.Message != tt.wantErr.Error() {
+				t.Errorf("message = %q, want %q", result.Message, tt.wantErr.Error())
+			}
+		})
+	}
+}
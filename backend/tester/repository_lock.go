@@ -0,0 +1,38 @@
+package tester
+
+import "sync"
+
+type repositoryLock struct {
+	mutex sync.Mutex
+	// holders and waiters, the lock is dropped from the map when it reaches 0
+	users int
+}
+
+var repositoryLocks = struct {
+	sync.Mutex
+	locks map[string]*repositoryLock
+}{locks: make(map[string]*repositoryLock)}
+
+// LockRepository keeps testings of a repository from being queued while its files are rewritten,
+// such as by a reset. It returns the function that unlocks it.
+func LockRepository(repositoryId string) func() {
+	repositoryLocks.Lock()
+	lock, ok := repositoryLocks.locks[repositoryId]
+	if !ok {
+		lock = &repositoryLock{}
+		repositoryLocks.locks[repositoryId] = lock
+	}
+	lock.users++
+	repositoryLocks.Unlock()
+
+	lock.mutex.Lock()
+	return func() {
+		lock.mutex.Unlock()
+		repositoryLocks.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(repositoryLocks.locks, repositoryId)
+		}
+		repositoryLocks.Unlock()
+	}
+}
@@ -1,30 +1,27 @@
 package tester
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"judge/challenge"
 	"judge/jConfig"
 	"judge/schema"
+	"judge/shared"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
 const STAGE_ENV_KEY = "STAGE"
+const DEFAULT_NETWORK_MODE = "none"
+const SOURCE_FOLDER = "source"
+
+var ErrHarnessWithoutCommand = errors.New("the startpoint has a TestHarness but no TestCommand")
 
 func getStartPoint(
 	challengeRecord *challenge.Challenge,
@@ -51,14 +48,14 @@ func handleTaskWaitingTimeout(
 	db *gorm.DB,
 	task *TestingTask,
 	timeoutMinutes int,
-) error {
-	if time.Since(task.WaitingStartTime) > time.Duration(timeoutMinutes)*time.Second {
+) (bool, error) {
+	if time.Since(task.WaitingStartTime) > time.Duration(timeoutMinutes)*time.Minute {
 		task.TestingRecord.Status = StatusWaitingTimeout
 		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
 		logger.Debug("Task waiting timeout", zap.String("repository_id", task.RepositoryId), zap.Int("serial", task.Serial), zap.Int("stage", task.Stage))
-		return db.Save(task.TestingRecord).Error
+		return true, saveTestingRecord(db, task.TestingRecord)
 	}
-	return nil
+	return false, nil
 }
 
 func initializeTaskExecution(
@@ -73,318 +70,272 @@ func initializeTaskExecution(
 
 	task.TestingRecord.Status = StatusRunning
 	task.TestingRecord.RunStartTime = time.Now().Format(time.RFC3339)
-	return db.Save(task.TestingRecord).Error
+	return saveTestingRecord(db, task.TestingRecord)
 }
 
-func setupExecutionPaths(
+// GetRepositoryPath is the bare repository the git server serves for a repository record.
+func GetRepositoryPath(
 	config *jConfig.JudgeConfig,
 	repositoryRecord *schema.Repository,
-	startpoint *challenge.StartPoint,
-	runId string,
-) (string, string, string, error) {
-	repositoryPath := filepath.Join(
+) string {
+	return filepath.Join(
 		config.RepositoryStorage.StorageFolder,
 		repositoryRecord.Provider,
 		repositoryRecord.Subject,
 		repositoryRecord.ChallengeFolderName,
 		repositoryRecord.RepositoryId,
 	)
-
-	dockerfilePath := filepath.Join(repositoryPath, startpoint.Dockerfile)
-	tempStoragePath := filepath.Join(config.Testing.TmpStorageFolder, runId)
-
-	if err := os.MkdirAll(tempStoragePath, 0755); err != nil {
-		return "", "", "", err
-	}
-
-	return repositoryPath, dockerfilePath, tempStoragePath, nil
 }
 
-func buildDockerImage(
-	docker *client.Client,
-	dockerfilePath string,
-	imageName string,
+// pinTestedCommit pins testings queued before commits were recorded to HEAD.
+func pinTestedCommit(
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	task *TestingTask,
 ) error {
-	tar, err := archive.TarWithOptions(
-		filepath.Join(
-			filepath.Dir(dockerfilePath),
-		), &archive.TarOptions{},
-	)
+	if task.TestingRecord.Commit != "" {
+		return nil
+	}
+	commit, err := shared.ResolveCommit(GetRepositoryPath(config, &task.Repository), "")
 	if err != nil {
 		return err
 	}
+	task.TestingRecord.Commit = commit
+	return saveTestingRecord(db, task.TestingRecord)
+}
 
-	buildResponse, err := docker.ImageBuild(
-		context.Background(),
-		tar,
-		types.ImageBuildOptions{
-			Dockerfile: filepath.Base(dockerfilePath),
-			Tags:       []string{imageName},
-			Remove:     true,
-		},
-	)
+// startTask moves a claimed task to running, it returns false if the task waited for too long.
+func startTask(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	task *TestingTask,
+) (bool, error) {
+	waitingTimeout, err := handleTaskWaitingTimeout(logger, db, task, config.Testing.PendingQueueTimeoutInMinute)
 	if err != nil {
-		return err
+		logger.Error("Failed to handle task timeout", zap.Error(err))
+		return false, err
 	}
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, buildResponse.Body); err != nil {
-		return err
+	if waitingTimeout {
+		return false, nil
 	}
 
-	defer buildResponse.Body.Close()
-	return nil
-}
-
-func createAndStartContainer(
-	docker *client.Client,
-	imageName string,
-	containerName string,
-	reportMountPath string,
-	timeout time.Duration, // 超时时间参数
-	stageEnvKey string,
-	stageEnvValue string,
-) (string, bool, error) {
-	containerConfig := &container.Config{
-		Image: imageName,
-		Tty:   true,
-		Env: []string{
-			fmt.Sprintf("%s=%s", stageEnvKey, stageEnvValue),
-		},
+	if err := initializeTaskExecution(logger, db, task); err != nil {
+		logger.Error("Failed to initialize task execution", zap.Error(err))
+		return false, err
 	}
 
-	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: reportMountPath,
-				Target: "/mnt/report",
-			},
-		},
+	if err := pinTestedCommit(config, db, task); err != nil {
+		logger.Error("Failed to pin commit", zap.Error(err))
+		return false, err
 	}
+	return true, nil
+}
 
-	containerHandle, err := docker.ContainerCreate(
-		context.Background(),
-		containerConfig,
-		hostConfig,
-		nil,
-		nil,
-		containerName,
-	)
-	if err != nil {
-		return "", false, err
+// resolveResourceLimits applies the overrides of the challenge and the stage to the configured defaults.
+func resolveResourceLimits(
+	config *jConfig.JudgeConfig,
+	challengeRecord *challenge.Challenge,
+	stage int,
+) jConfig.ResourceLimitsConfig {
+	limits := config.Testing.Limits.Override(challengeRecord.Limits)
+	if stageRecord := getStage(challengeRecord, stage); stageRecord != nil {
+		limits = limits.Override(stageRecord.Limits)
 	}
-
-	// 启动容器
-	if err := docker.ContainerStart(context.Background(), containerHandle.ID, container.StartOptions{}); err != nil {
-		return "", false, err
+	if limits.NetworkMode == "" {
+		limits.NetworkMode = DEFAULT_NETWORK_MODE
 	}
+	return limits
+}
 
-	// 设置超时上下文
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	// 等待容器完成或超时
-	statusCh, errCh := docker.ContainerWait(ctx, containerHandle.ID, container.WaitConditionNotRunning)
-	select {
-	case <-ctx.Done(): // 超时
-		// 超时则强制停止容器
-		if stopErr := docker.ContainerStop(context.Background(), containerHandle.ID, container.StopOptions{}); stopErr != nil {
-			return "", true, fmt.Errorf("failed to stop container on timeout: %w", stopErr)
+// applyTestHarness mounts the hidden tests of the startpoint, so the student cannot change them.
+// A harness without TestCommand is refused, the CMD of the student dockerfile would run instead of it.
+func applyTestHarness(
+	challengePath string,
+	startpoint *challenge.StartPoint,
+	runSpec *RunSpec,
+) error {
+	if startpoint.TestHarness != "" {
+		if len(startpoint.TestCommand) == 0 {
+			return ErrHarnessWithoutCommand
 		}
-		return "", true, fmt.Errorf("container execution timed out")
-
-	case err := <-errCh: // 容器执行出错
+		harnessPath, err := filepath.Abs(filepath.Join(challengePath, startpoint.TestHarness))
 		if err != nil {
-			return "", false, err
+			return err
 		}
-
-	case <-statusCh: // 容器完成
-	}
-
-	// 获取容器日志
-	out, err := docker.ContainerLogs(context.Background(), containerHandle.ID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-	})
-	if err != nil {
-		return "", false, err
-	}
-	defer out.Close()
-
-	// 将日志输出转换为字符串
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, out); err != nil {
-		return "", false, err
-	}
-	return buf.String(), false, nil
+		if _, err := os.Stat(harnessPath); err != nil {
+			return err
+		}
+		runSpec.Mounts = append(runSpec.Mounts, MountSpec{
+			Source:   harnessPath,
+			Target:   HARNESS_MOUNT_PATH,
+			ReadOnly: true,
+		})
+		runSpec.Env = append(runSpec.Env, fmt.Sprintf("%s=%s", HARNESS_DIR_ENV_KEY, HARNESS_MOUNT_PATH))
+	}
+	runSpec.Command = startpoint.TestCommand
+	return nil
 }
 
-const REPORT_MESSAGE_FILE = "message.md"
-const REPORT_RESULT_FILE = "result"
-
-func readReport(
-	logger *zap.Logger,
-	reportPath string,
-) (bool, string, error) {
-	reportMessageFile := filepath.Join(reportPath, REPORT_MESSAGE_FILE)
-	reportResultFile := filepath.Join(reportPath, REPORT_RESULT_FILE)
-	logger.Debug("Reading report", zap.String("report_path", reportPath))
-	reportMessage, err := os.ReadFile(reportMessageFile)
-	if err != nil {
-		logger.Error("Failed to read report message file", zap.Error(err))
-		return false, "", err
-	}
-	reportResult, err := os.ReadFile(reportResultFile)
-	if err != nil {
-		logger.Error("Failed to read report result file", zap.Error(err))
-		return false, "", err
-	}
-	if strings.HasPrefix(strings.ToLower(string(reportResult)), "t") {
-		return true, string(reportMessage), nil
-	}
-	if strings.HasPrefix(strings.ToLower(string(reportResult)), "f") {
-		return false, string(reportMessage), nil
-	}
-	logger.Warn("Unrecognized report result, supposing it failed", zap.String("result", string(reportResult)))
-	return false, string(reportMessage), nil
+// taskOutcome is what running a task produced, it is sent back by remote workers as is.
+type taskOutcome struct {
+	BuildLog    string         `json:"buildLog"`
+	BuildFailed bool           `json:"buildFailed"`
+	Results     []*stageResult `json:"results"`
 }
 
-func runTask(
+// executeTask builds and runs a task without touching the database,
+// so it is shared by the listener and remote workers.
+// checkout fills the given folder with the tested source,
+// challengePath is the folder the test harness and the stage mounts are found in.
+func executeTask(
+	ctx context.Context,
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
-	db *gorm.DB,
-	docker *client.Client,
+	sandbox Sandbox,
 	task *TestingTask,
-) error {
-	if err := handleTaskWaitingTimeout(logger, db, task, config.Testing.PendingQueueTimeoutInMinute); err != nil {
-		logger.Error("Failed to handle task timeout", zap.Error(err))
-		return err
-	}
-
-	if err := initializeTaskExecution(logger, db, task); err != nil {
-		logger.Error("Failed to initialize task execution", zap.Error(err))
-		return err
-	}
-
-	repositoryRecord := &schema.Repository{}
-	if err := db.Where("repository_id = ?", task.RepositoryId).First(repositoryRecord).Error; err != nil {
-		logger.Error("Failed to get repository record", zap.Error(err))
-		return err
-	}
-
-	startpoint, err := getStartPoint(&task.Challenge, repositoryRecord.Startpoint)
+	checkout func(sourcePath string) error,
+	challengePath string,
+) (*taskOutcome, error) {
+	startpoint, err := getStartPoint(&task.Challenge, task.Repository.Startpoint)
 	if err != nil {
 		logger.Error("Failed to get startpoint", zap.Error(err))
-		return err
+		return nil, err
+	}
+	if startpoint == nil {
+		logger.Error("Startpoint not found", zap.String("startpoint", task.Repository.Startpoint))
+		return nil, fmt.Errorf("startpoint %s not found", task.Repository.Startpoint)
 	}
 
 	runId := fmt.Sprintf("%s-%s-%s-%d-%d",
 		task.RepositoryId,
-		repositoryRecord.Provider,
-		repositoryRecord.Subject,
+		task.Repository.Provider,
+		task.Repository.Subject,
 		task.Serial,
 		task.Stage)
 	runId = fmt.Sprintf("%s-%d", runId, time.Now().UnixMilli())
 	runId = strings.ToLower(runId)
-	imageName := fmt.Sprintf("image-%s", runId)
-	containerName := fmt.Sprintf("container-%s", runId)
-	_, dockerfilePath, tempStoragePath, err := setupExecutionPaths(config, repositoryRecord, startpoint, runId)
-	defer cleanUp(logger, docker, imageName, containerName, tempStoragePath)
+	tempStoragePath := filepath.Join(config.Testing.TmpStorageFolder, runId)
+	runSpec := &RunSpec{
+		ImageName:     fmt.Sprintf("image-%s", runId),
+		ContainerName: fmt.Sprintf("container-%s", runId),
+		Timeout:       time.Duration(config.Testing.RunningTimeoutInMinute) * time.Minute,
+		Output:        task.LiveLog,
+	}
+	stageSpecs := make([]*RunSpec, 0)
+	defer func() {
+		cleanUp(logger, sandbox, append(stageSpecs, runSpec), tempStoragePath)
+	}()
 
-	if err != nil {
+	if err := os.MkdirAll(tempStoragePath, 0755); err != nil {
 		logger.Error("Failed to setup execution paths", zap.Error(err))
-		return err
+		return nil, err
 	}
 
-	logger.Debug("Dockerfile path", zap.String("dockerfilePath", dockerfilePath))
-	if err := buildDockerImage(docker, dockerfilePath, imageName); err != nil {
-		logger.Error("Failed to build docker image", zap.Error(err))
-		return err
+	if err := applyTestHarness(challengePath, startpoint, runSpec); err != nil {
+		logger.Error("Failed to apply test harness", zap.Error(err))
+		return nil, err
 	}
 
-	reportMountPath := filepath.Join(tempStoragePath, "report")
-	// convert to absolute path
-	reportMountPath, err = filepath.Abs(reportMountPath)
-	err = os.MkdirAll(reportMountPath, 0755)
-	if err != nil {
-		logger.Error("Failed to create report mount path", zap.Error(err))
-		return err
+	sourcePath := filepath.Join(tempStoragePath, SOURCE_FOLDER)
+	logger.Debug("Checking out commit", zap.String("commit", task.TestingRecord.Commit), zap.String("sourcePath", sourcePath))
+	if err := checkout(sourcePath); err != nil {
+		logger.Error("Failed to check out commit", zap.Error(err))
+		return nil, err
 	}
-	logger.Debug("Report mount path", zap.String("reportMountPath", reportMountPath))
-	log, stoppedBecauseTimeout, err := createAndStartContainer(
-		docker,
-		imageName,
-		containerName,
-		reportMountPath,
-		time.Duration(config.Testing.RunningTimeoutInMinute)*time.Minute,
-		STAGE_ENV_KEY,
-		fmt.Sprintf("%d", task.Stage),
-	)
 
+	dockerfilePath := filepath.Join(sourcePath, startpoint.Dockerfile)
+	logger.Debug("Dockerfile path", zap.String("dockerfilePath", dockerfilePath))
+	buildSpec := &BuildSpec{
+		ContextPath: filepath.Dir(dockerfilePath),
+		Dockerfile:  filepath.Base(dockerfilePath),
+		ImageName:   runSpec.ImageName,
+		Output:      task.LiveLog,
+	}
+	buildSpec.CacheImage, err = buildCacheImage(&task.Challenge, startpoint, sourcePath)
 	if err != nil {
-		logger.Error("Failed to create and start container", zap.Error(err))
-		task.TestingRecord.Status = StatusError
-		task.TestingRecord.Log = log
-		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-		err = db.Save(&task.TestingRecord).Error
-		if err != nil {
-			logger.Error("Failed to save task record", zap.Error(err))
-		}
-		return err
+		logger.Error("Failed to compute cache image", zap.Error(err))
+		return nil, err
+	}
+	buildResult, err := sandbox.Build(ctx, buildSpec)
+	if err != nil {
+		logger.Error("Failed to build image", zap.Error(err))
+		return nil, err
+	}
+	outcome := &taskOutcome{
+		BuildLog:    buildResult.Log,
+		BuildFailed: buildResult.Failed,
+	}
+	if buildResult.Failed {
+		return outcome, nil
 	}
 
-	if stoppedBecauseTimeout {
-		task.TestingRecord.Status = StatusRunningTimeout
-		task.TestingRecord.Log = log
-		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-		err = db.Save(&task.TestingRecord).Error
+	// the image is built once and run for every tested stage
+	for _, stage := range testedStages(task) {
+		stageSpec, err := stageRunSpec(config, task, runSpec, tempStoragePath, challengePath, stage)
 		if err != nil {
-			logger.Error("Failed to save task record", zap.Error(err))
+			logger.Error("Failed to prepare stage", zap.Error(err), zap.Int("stage", stage))
+			return nil, err
 		}
-		return err
+		stageSpecs = append(stageSpecs, stageSpec)
+		if task.TestingRecord.Regression {
+			writeStageHeader(task.LiveLog, stage)
+		}
+		result, err := runStage(ctx, logger, sandbox, stageSpec, stage, stageMaxScore(&task.Challenge, stage))
+		if err != nil {
+			return nil, err
+		}
+		outcome.Results = append(outcome.Results, result)
 	}
+	return outcome, nil
+}
 
-	task.TestingRecord.Status = StatusSuccess
-	task.TestingRecord.Log = log
+// recordTaskOutcome stores the outcome of a task, and advances the repository if it passed.
+func recordTaskOutcome(
+	logger *zap.Logger,
+	db *gorm.DB,
+	task *TestingTask,
+	outcome *taskOutcome,
+) error {
+	task.TestingRecord.BuildLog = outcome.BuildLog
+	if outcome.BuildFailed {
+		task.TestingRecord.Status = StatusBuildFailed
+	} else {
+		summarizeStages(task.TestingRecord, outcome.Results)
+	}
 	task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-	err = db.Save(&task.TestingRecord).Error
-	if err != nil {
-		logger.Error("Failed to save task record", zap.Error(err))
+	// saved first, nothing else of a testing cancelled in the meantime may be recorded
+	err := saveTestingRecord(db, task.TestingRecord)
+	if errors.Is(err, ErrTestingDropped) {
+		logger.Info("Dropped the result of a cancelled task",
+			zap.String("repository_id", task.RepositoryId),
+			zap.Int("serial", task.Serial))
+		return nil
 	}
-
-	pass, message, err := readReport(logger, reportMountPath)
 	if err != nil {
-		logger.Error("Failed to read report", zap.Error(err))
+		logger.Error("Failed to save task record", zap.Error(err))
 		return err
 	}
-	if !pass {
-		task.TestingRecord.Status = StatusFailed
-		task.TestingRecord.Log = log
-		task.TestingRecord.Message = message
-		task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-		err = db.Save(&task.TestingRecord).Error
-		if err != nil {
-			logger.Error("Failed to save task record", zap.Error(err))
-		}
+	if outcome.BuildFailed {
 		return nil
 	}
-	task.TestingRecord.Status = StatusSuccess
-	task.TestingRecord.Log = log
-	task.TestingRecord.Message = message
-	task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
-	err = db.Save(&task.TestingRecord).Error
-	if err != nil {
-		logger.Error("Failed to save task record", zap.Error(err))
+	if err := saveTestingStages(db, task.TestingRecord, outcome.Results); err != nil {
+		logger.Error("Failed to save testing stages", zap.Error(err))
+		return err
 	}
-	// advance the stage of repo by one
-	if repositoryRecord.Stage <= int32(task.Stage)+1 {
-		repositoryRecord.Stage = int32(task.Stage) + 1
-		err = db.Save(&repositoryRecord).Error
-		if err != nil {
-			logger.Error("Failed to save repository record", zap.Error(err))
-		}
+	// failed stages count as well, they may have earned partial credit
+	if err := saveBestScores(db, task.TestingRecord, outcome.Results); err != nil {
+		logger.Error("Failed to save scores", zap.Error(err))
+		return err
+	}
+	if task.TestingRecord.Status != StatusSuccess {
+		return nil
 	}
-	err = db.Save(&repositoryRecord).Error
+
+	// advance the stage of repo by one, only the column so concurrent changes to the repository survive
+	err = db.Model(&schema.Repository{}).
+		Where("repository_id = ? AND stage < ?", task.RepositoryId, task.Stage+1).
+		Update("stage", task.Stage+1).Error
 	if err != nil {
 		logger.Error("Failed to save repository record", zap.Error(err))
 		return err
@@ -392,45 +343,43 @@ func runTask(
 	return nil
 }
 
-func cleanUp(
+// runTask runs a claimed task in this process.
+func runTask(
+	ctx context.Context,
 	logger *zap.Logger,
-	docker *client.Client,
-	imageName string,
-	containerName string,
-	tempStoragePath string,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	sandbox Sandbox,
+	task *TestingTask,
 ) error {
-	containers, err := docker.ContainerList(context.Background(), container.ListOptions{
-		All: true,
-	})
-	if err != nil {
-		logger.Error("Failed to list containers", zap.Error(err))
+	started, err := startTask(logger, config, db, task)
+	if err != nil || !started {
 		return err
 	}
 
-	var containerID string
-	for _, c := range containers {
-		if c.Names[0] == "/"+containerName { // Docker prepends a '/' to container names
-			containerID = c.ID
-			break
-		}
-	}
-	if containerID == "" {
-		logger.Warn("Container not found", zap.String("containerName", containerName))
-	} else {
-		if err := docker.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true}); err != nil {
-			logger.Error("Failed to remove container", zap.Error(err))
-			return err
-		}
-	}
-
-	if _, err := docker.ImageRemove(context.Background(), imageName, image.RemoveOptions{Force: true}); err != nil {
-		logger.Error("Failed to remove image", zap.Error(err))
+	repositoryPath := GetRepositoryPath(config, &task.Repository)
+	challengePath := filepath.Join(config.Challenge.StorageFolder, task.Challenge.FolderName)
+	outcome, err := executeTask(ctx, logger, config, sandbox, task, func(sourcePath string) error {
+		return shared.ExportCommit(repositoryPath, task.TestingRecord.Commit, sourcePath)
+	}, challengePath)
+	if err != nil {
 		return err
 	}
+	return recordTaskOutcome(logger, db, task, outcome)
+}
 
-	if _, err := docker.ImagesPrune(context.Background(), filters.Args{}); err != nil {
-		logger.Error("Failed to prune dangling images", zap.Error(err))
-		return err
+func cleanUp(
+	logger *zap.Logger,
+	sandbox Sandbox,
+	runSpecs []*RunSpec,
+	tempStoragePath string,
+) error {
+	var cleanUpErr error
+	for _, runSpec := range runSpecs {
+		if err := sandbox.CleanUp(context.Background(), runSpec); err != nil {
+			logger.Error("Failed to clean up sandbox", zap.Error(err))
+			cleanUpErr = err
+		}
 	}
 
 	if err := os.RemoveAll(tempStoragePath); err != nil {
@@ -438,5 +387,5 @@ func cleanUp(
 		return err
 	}
 
-	return nil
+	return cleanUpErr
 }
@@ -0,0 +1,197 @@
+package tester
+
+import (
+	"context"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// newTestDB opens an empty database in a temporary folder with the tables of the tester.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "judge.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(
+		&schema.Repository{},
+		&schema.Testing{},
+		&schema.TestingStage{},
+		&schema.TestingCase{},
+		&schema.RepositoryStageScore{},
+		&schema.RepositoryTestingSerial{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestRepository commits a dockerfile into a new repository and returns the commit.
+func newTestRepository(t *testing.T, config *jConfig.JudgeConfig, repositoryRecord *schema.Repository) string {
+	t.Helper()
+	repositoryPath := GetRepositoryPath(config, repositoryRecord)
+	repo, err := git.PlainInit(repositoryPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repositoryPath, "dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("dockerfile"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit("initial", &git.CommitOptions{
+		Author: &object.Signature{Name: "student", Email: "student@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestRunTask(t *testing.T) {
+	tests := []struct {
+		name       string
+		sandbox    *FakeSandbox
+		regression bool
+		wantStatus string
+		wantRuns   int
+		wantStage  int32
+		wantStages int64
+	}{
+		{
+			name:       "passing stage advances the repository",
+			sandbox:    &FakeSandbox{},
+			wantStatus: StatusSuccess,
+			wantRuns:   1,
+			wantStage:  2,
+			wantStages: 1,
+		},
+		{
+			name: "failing stage keeps the stage",
+			sandbox: &FakeSandbox{RunFunc: func(spec *RunSpec) (*RunResult, error) {
+				return &RunResult{}, WriteFakeReport(spec.ReportPath, false, "wrong answer")
+			}},
+			wantStatus: StatusFailed,
+			wantRuns:   1,
+			wantStage:  1,
+			wantStages: 1,
+		},
+		{
+			name: "timeout",
+			sandbox: &FakeSandbox{RunFunc: func(spec *RunSpec) (*RunResult, error) {
+				return &RunResult{TimedOut: true}, nil
+			}},
+			wantStatus: StatusRunningTimeout,
+			wantRuns:   1,
+			wantStage:  1,
+			wantStages: 1,
+		},
+		{
+			name:       "regression runs every stage up to the tested one",
+			sandbox:    &FakeSandbox{},
+			regression: true,
+			wantStatus: StatusSuccess,
+			wantRuns:   2,
+			wantStage:  2,
+			wantStages: 2,
+		},
+		{
+			name:       "build failure runs nothing",
+			sandbox:    &FakeSandbox{BuildFailed: true},
+			wantStatus: StatusBuildFailed,
+			wantRuns:   0,
+			wantStage:  1,
+			wantStages: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			config := &jConfig.JudgeConfig{}
+			config.RepositoryStorage.StorageFolder = t.TempDir()
+			config.Challenge.StorageFolder = t.TempDir()
+			config.Testing.TmpStorageFolder = t.TempDir()
+			config.Testing.RunningTimeoutInMinute = 1
+			config.Testing.PendingQueueTimeoutInMinute = 1
+
+			repositoryRecord := schema.Repository{
+				RepositoryId:        "repo",
+				Provider:            "provider",
+				Subject:             "subject",
+				ChallengeFolderName: "challenge",
+				Startpoint:          "go",
+				Stage:               1,
+			}
+			db.Create(&repositoryRecord)
+			commit := newTestRepository(t, config, &repositoryRecord)
+			testingRecord := schema.Testing{
+				RepositoryId: "repo",
+				Serial:       1,
+				Stage:        1,
+				Status:       StatusPending,
+				Commit:       commit,
+				Regression:   tt.regression,
+			}
+			db.Create(&testingRecord)
+
+			task := &TestingTask{
+				RepositoryId: "repo",
+				Serial:       1,
+				Stage:        1,
+				Challenge: challenge.Challenge{
+					FolderName:  "challenge",
+					StartPoints: []challenge.StartPoint{{Name: "go", Dockerfile: "dockerfile"}},
+					Stages:      []challenge.Stage{{Name: "first"}, {Name: "second"}},
+				},
+				Repository:       repositoryRecord,
+				TestingRecord:    &testingRecord,
+				WaitingStartTime: time.Now(),
+			}
+			if err := runTask(context.Background(), zap.NewNop(), config, db, tt.sandbox, task); err != nil {
+				t.Fatal(err)
+			}
+
+			var saved schema.Testing
+			db.Where("repository_id = ? AND serial = ?", "repo", 1).First(&saved)
+			if saved.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", saved.Status, tt.wantStatus)
+			}
+			if runs := len(tt.sandbox.Runs()); runs != tt.wantRuns {
+				t.Errorf("runs = %d, want %d", runs, tt.wantRuns)
+			}
+			var savedRepository schema.Repository
+			db.Where("repository_id = ?", "repo").First(&savedRepository)
+			if savedRepository.Stage != tt.wantStage {
+				t.Errorf("repository stage = %d, want %d", savedRepository.Stage, tt.wantStage)
+			}
+			var stages int64
+			db.Model(&schema.TestingStage{}).Where("repository_id = ?", "repo").Count(&stages)
+			if stages != tt.wantStages {
+				t.Errorf("testing stages = %d, want %d", stages, tt.wantStages)
+			}
+			if images := tt.sandbox.Images(); images != 0 {
+				t.Errorf("%d images left after clean up", images)
+			}
+			if entries, _ := os.ReadDir(config.Testing.TmpStorageFolder); len(entries) != 0 {
+				t.Errorf("temp storage left after clean up: %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"judge/jConfig"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SandboxDocker = "docker"
+	SandboxPodman = "podman"
+	SandboxLocal  = "local"
+)
+
+const REPORT_DIR_ENV_KEY = "REPORT_DIR"
+const REPORT_MOUNT_PATH = "/mnt/report"
+const HARNESS_DIR_ENV_KEY = "HARNESS_DIR"
+const HARNESS_MOUNT_PATH = "/mnt/harness"
+
+// BuildSpec describes how to turn a build context into something runnable.
+type BuildSpec struct {
+	// directory sent as the build context
+	ContextPath string
+	// dockerfile path relative to ContextPath
+	Dockerfile string
+	ImageName  string
+	// optional, builds with the same cache image reuse the layers of each other
+	CacheImage string
+	// optional, receives the build output while it is produced
+	Output io.Writer
+}
+
+type BuildResult struct {
+	Log string
+	// the dockerfile could not be built, as opposed to the sandbox failing
+	Failed bool
+}
+
+// MountSpec binds a host folder into the sandbox.
+type MountSpec struct {
+	// absolute host path
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// RunSpec describes a single run of a built image.
+type RunSpec struct {
+	ImageName     string
+	ContainerName string
+	// absolute host path the report is written into
+	ReportPath string
+	Env        []string
+	Timeout    time.Duration
+	// optional, replaces the command of the image
+	Command []string
+	Mounts  []MountSpec
+	Limits  jConfig.ResourceLimitsConfig
+	// optional, receives the output while it is produced
+	Output io.Writer
+}
+
+type RunResult struct {
+	Log            string
+	TimedOut       bool
+	MemoryExceeded bool
+}
+
+// Sandbox is the execution backend used by runTask.
+// Implementations must be safe for concurrent use by several workers.
+type Sandbox interface {
+	Build(ctx context.Context, spec *BuildSpec) (*BuildResult, error)
+	Run(ctx context.Context, spec *RunSpec) (*RunResult, error)
+	// CleanUp removes everything Build and Run left behind for the given spec.
+	CleanUp(ctx context.Context, spec *RunSpec) error
+}
+
+func NewSandbox(logger *zap.Logger, config *jConfig.JudgeConfig) (Sandbox, error) {
+	switch config.Testing.Sandbox {
+	case SandboxDocker, "":
+		return NewDockerSandbox(logger, config.Testing.DockerSocket, config.Testing.ImageCache)
+	case SandboxPodman:
+		return NewPodmanSandbox(logger, config.Testing.PodmanSocket, config.Testing.ImageCache)
+	case SandboxLocal:
+		return NewLocalSandbox(logger, config.Testing.TmpStorageFolder)
+	}
+	return nil, fmt.Errorf("unknown sandbox %q, choose one from docker, podman, local", config.Testing.Sandbox)
+}
@@ -0,0 +1,327 @@
+package tester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"judge/jConfig"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/archive"
+	"go.uber.org/zap"
+)
+
+const LOG_DRAIN_TIMEOUT = 10 * time.Second
+
+// DockerSandbox builds and runs submissions on a Docker daemon.
+type DockerSandbox struct {
+	logger *zap.Logger
+	docker *client.Client
+	// nil if images are not cached
+	cache *imageCache
+}
+
+func NewDockerSandbox(logger *zap.Logger, socketPath string, cacheConfig jConfig.ImageCacheConfig) (*DockerSandbox, error) {
+	dockerClient, err := client.NewClientWithOpts(
+		client.WithHost(socketPath),
+	)
+	if err != nil {
+		logger.Error("Failed to create Docker client", zap.Error(err))
+		return nil, err
+	}
+	sandbox := &DockerSandbox{
+		logger: logger,
+		docker: dockerClient,
+	}
+	if cacheConfig.Enabled {
+		sandbox.cache = newImageCache(logger, cacheConfig)
+	}
+	return sandbox, nil
+}
+
+// buildMessage is one JSON message of the build output stream.
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// readBuildOutput decodes the JSON messages of a build into plain text.
+// It returns the message of the error that failed the build, if any.
+func readBuildOutput(body io.Reader, output io.Writer) (string, string, error) {
+	var buf bytes.Buffer
+	writer := io.Writer(&buf)
+	if output != nil {
+		writer = io.MultiWriter(&buf, output)
+	}
+	decoder := json.NewDecoder(body)
+	for {
+		var message buildMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return buf.String(), "", nil
+		} else if err != nil {
+			return buf.String(), "", err
+		}
+		if message.ErrorDetail != nil || message.Error != "" {
+			errorMessage := message.Error
+			if message.ErrorDetail != nil && message.ErrorDetail.Message != "" {
+				errorMessage = message.ErrorDetail.Message
+			}
+			fmt.Fprintln(writer, errorMessage)
+			return buf.String(), errorMessage, nil
+		}
+		if message.Stream != "" {
+			io.WriteString(writer, message.Stream)
+		} else if message.Status != "" {
+			// pulling the base image
+			if message.ID != "" {
+				fmt.Fprintf(writer, "%s: %s\n", message.ID, message.Status)
+			} else {
+				fmt.Fprintln(writer, message.Status)
+			}
+		}
+	}
+}
+
+func (s *DockerSandbox) Build(ctx context.Context, spec *BuildSpec) (*BuildResult, error) {
+	tar, err := archive.TarWithOptions(spec.ContextPath, &archive.TarOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	options := types.ImageBuildOptions{
+		Dockerfile: spec.Dockerfile,
+		Tags:       []string{spec.ImageName},
+		Remove:     true,
+	}
+	useCache := s.cache != nil && spec.CacheImage != ""
+	if useCache {
+		// the cache tag keeps the layers alive after CleanUp removed the image of the run
+		options.Tags = append(options.Tags, spec.CacheImage)
+		options.CacheFrom = []string{spec.CacheImage}
+		options.Labels = map[string]string{CACHE_IMAGE_LABEL: "true"}
+	}
+	buildResponse, err := s.docker.ImageBuild(ctx, tar, options)
+	if err != nil {
+		return nil, err
+	}
+	defer buildResponse.Body.Close()
+
+	log, errorMessage, err := readBuildOutput(buildResponse.Body, spec.Output)
+	if err != nil {
+		return nil, err
+	}
+	if errorMessage != "" {
+		s.logger.Debug("Build failed", zap.String("imageName", spec.ImageName), zap.String("error", errorMessage))
+		return &BuildResult{Log: log, Failed: true}, nil
+	}
+
+	if useCache {
+		s.cache.touch(spec.CacheImage)
+		if err := s.cache.evict(ctx, s.docker, spec.CacheImage); err != nil {
+			s.logger.Warn("Failed to evict cached images", zap.Error(err))
+		}
+	}
+	return &BuildResult{Log: log}, nil
+}
+
+const MEGABYTE = 1024 * 1024
+
+func applyResourceLimits(hostConfig *container.HostConfig, limits *jConfig.ResourceLimitsConfig) {
+	if limits.MemoryInMegabytes > 0 {
+		hostConfig.Memory = limits.MemoryInMegabytes * MEGABYTE
+		// no swap on top of the memory limit
+		hostConfig.MemorySwap = hostConfig.Memory
+	}
+	if limits.Cpus > 0 {
+		hostConfig.NanoCPUs = int64(limits.Cpus * 1e9)
+	}
+	if limits.PidsLimit > 0 {
+		pidsLimit := limits.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	if limits.TmpfsSizeInMegabytes > 0 {
+		hostConfig.Tmpfs = map[string]string{
+			"/tmp": fmt.Sprintf("rw,size=%dm", limits.TmpfsSizeInMegabytes),
+		}
+	}
+	if limits.DiskSizeInMegabytes > 0 {
+		hostConfig.StorageOpt = map[string]string{
+			"size": fmt.Sprintf("%dM", limits.DiskSizeInMegabytes),
+		}
+	}
+	hostConfig.NetworkMode = container.NetworkMode(limits.NetworkMode)
+	if limits.ReadOnlyRootfs != nil {
+		hostConfig.ReadonlyRootfs = *limits.ReadOnlyRootfs
+	}
+	hostConfig.CapDrop = limits.DropCapabilities
+}
+
+func (s *DockerSandbox) Run(ctx context.Context, spec *RunSpec) (*RunResult, error) {
+	containerConfig := &container.Config{
+		Image: spec.ImageName,
+		Tty:   true,
+		// REPORT_DIR last, so the env of a stage cannot move the report away from where it is read
+		Env: append(
+			append([]string{}, spec.Env...),
+			fmt.Sprintf("%s=%s", REPORT_DIR_ENV_KEY, REPORT_MOUNT_PATH),
+		),
+	}
+	if len(spec.Command) > 0 {
+		containerConfig.Cmd = spec.Command
+	}
+
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: spec.ReportPath,
+				Target: REPORT_MOUNT_PATH,
+			},
+		},
+	}
+	applyResourceLimits(hostConfig, &spec.Limits)
+	for _, m := range spec.Mounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	containerHandle, err := s.docker.ContainerCreate(
+		ctx,
+		containerConfig,
+		hostConfig,
+		nil,
+		nil,
+		spec.ContainerName,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// 启动容器
+	if err := s.docker.ContainerStart(ctx, containerHandle.ID, container.StartOptions{}); err != nil {
+		return nil, err
+	}
+
+	// follow the output from the start, the stream ends once the container stops
+	logs, err := s.docker.ContainerLogs(ctx, containerHandle.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+	var buf bytes.Buffer
+	var output io.Writer = &buf
+	if spec.Output != nil {
+		output = io.MultiWriter(&buf, spec.Output)
+	}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(output, logs)
+		copied <- err
+	}()
+	waitForLogs := func() {
+		select {
+		case <-copied:
+		case <-time.After(LOG_DRAIN_TIMEOUT):
+			s.logger.Warn("Timed out draining container logs", zap.String("containerName", spec.ContainerName))
+		}
+	}
+
+	// 设置超时上下文
+	waitCtx, cancel := context.WithTimeout(ctx, spec.Timeout)
+	defer cancel()
+
+	// 等待容器完成或超时
+	statusCh, errCh := s.docker.ContainerWait(waitCtx, containerHandle.ID, container.WaitConditionNotRunning)
+	select {
+	case <-waitCtx.Done(): // 超时
+		// 超时则强制停止容器
+		if stopErr := s.docker.ContainerStop(context.Background(), containerHandle.ID, container.StopOptions{}); stopErr != nil {
+			return &RunResult{TimedOut: true}, fmt.Errorf("failed to stop container on timeout: %w", stopErr)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		waitForLogs()
+		return &RunResult{Log: buf.String(), TimedOut: true}, nil
+
+	case err := <-errCh: // 容器执行出错
+		if err != nil {
+			return nil, err
+		}
+
+	case <-statusCh: // 容器完成
+	}
+
+	waitForLogs()
+	inspect, err := s.docker.ContainerInspect(context.Background(), containerHandle.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &RunResult{
+		Log:            buf.String(),
+		MemoryExceeded: inspect.State != nil && inspect.State.OOMKilled,
+	}, nil
+}
+
+func (s *DockerSandbox) CleanUp(ctx context.Context, spec *RunSpec) error {
+	containers, err := s.docker.ContainerList(ctx, container.ListOptions{
+		All: true,
+	})
+	if err != nil {
+		s.logger.Error("Failed to list containers", zap.Error(err))
+		return err
+	}
+
+	var containerID string
+	for _, c := range containers {
+		if c.Names[0] == "/"+spec.ContainerName { // Docker prepends a '/' to container names
+			containerID = c.ID
+			break
+		}
+	}
+	if containerID == "" {
+		s.logger.Warn("Container not found", zap.String("containerName", spec.ContainerName))
+	} else {
+		if err := s.docker.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true}); err != nil {
+			s.logger.Error("Failed to remove container", zap.Error(err))
+			return err
+		}
+	}
+
+	// the image is shared by the runs of every stage, only the first clean up removes it
+	_, err = s.docker.ImageRemove(ctx, spec.ImageName, image.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		s.logger.Error("Failed to remove image", zap.Error(err))
+		return err
+	}
+
+	// cached images are tagged, only the images they replaced become dangling
+	if _, err := s.docker.ImagesPrune(ctx, filters.Args{}); err != nil {
+		s.logger.Error("Failed to prune dangling images", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
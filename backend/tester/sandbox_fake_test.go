@@ -0,0 +1,79 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FakeSandbox is an in-memory Sandbox for tests, nothing is built or run.
+// Run writes a report into the report folder the way a test in the image would,
+// so everything around the sandbox can be tested without docker.
+type FakeSandbox struct {
+	// Build fails like a broken dockerfile when set
+	BuildFailed bool
+	// decides the outcome of each run, every stage passes if it is nil
+	RunFunc func(spec *RunSpec) (*RunResult, error)
+
+	mutex  sync.Mutex
+	images map[string]bool
+	runs   []*RunSpec
+}
+
+// WriteFakeReport writes the plain report a passing or failing test would write.
+func WriteFakeReport(reportPath string, pass bool, message string) error {
+	if err := os.WriteFile(filepath.Join(reportPath, REPORT_RESULT_FILE), []byte(fmt.Sprint(pass)), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(reportPath, REPORT_MESSAGE_FILE), []byte(message), 0644)
+}
+
+func (s *FakeSandbox) Build(ctx context.Context, spec *BuildSpec) (*BuildResult, error) {
+	if s.BuildFailed {
+		return &BuildResult{Log: "fake build failed\n", Failed: true}, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.images == nil {
+		s.images = make(map[string]bool)
+	}
+	s.images[spec.ImageName] = true
+	return &BuildResult{Log: "fake build\n"}, nil
+}
+
+func (s *FakeSandbox) Run(ctx context.Context, spec *RunSpec) (*RunResult, error) {
+	s.mutex.Lock()
+	built := s.images[spec.ImageName]
+	s.runs = append(s.runs, spec)
+	s.mutex.Unlock()
+	if !built {
+		return nil, fmt.Errorf("fake image %s not built", spec.ImageName)
+	}
+	if s.RunFunc != nil {
+		return s.RunFunc(spec)
+	}
+	return &RunResult{Log: "fake run\n"}, WriteFakeReport(spec.ReportPath, true, "passed")
+}
+
+func (s *FakeSandbox) CleanUp(ctx context.Context, spec *RunSpec) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.images, spec.ImageName)
+	return nil
+}
+
+// Runs are the specs Run was called with, in order.
+func (s *FakeSandbox) Runs() []*RunSpec {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*RunSpec(nil), s.runs...)
+}
+
+// Images counts the images built and not cleaned up yet.
+func (s *FakeSandbox) Images() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.images)
+}
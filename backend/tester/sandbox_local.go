@@ -0,0 +1,224 @@
+package tester
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"judge/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const LOCAL_IMAGE_FOLDER = "local-images"
+const LOCAL_WAIT_DELAY = 5 * time.Second
+
+type localImage struct {
+	dir     string
+	command []string
+	env     []string
+}
+
+// LocalSandbox runs submissions as plain processes on the host.
+// There is no isolation at all, so it is only meant for trusted single-user installs.
+// "Building" copies the build context and reads ENV, ENTRYPOINT and CMD from the dockerfile;
+// the command is then run from the root of the copied context, so it should use relative paths.
+// Mounts cannot be made without a container, so mount targets in the command and
+// the environment are replaced by their host paths instead, and read-only is not enforced.
+// Resource limits and the image cache are ignored as well.
+type LocalSandbox struct {
+	logger      *zap.Logger
+	imageFolder string
+	mutex       sync.Mutex
+	images      map[string]*localImage
+}
+
+func NewLocalSandbox(logger *zap.Logger, tmpStorageFolder string) (*LocalSandbox, error) {
+	imageFolder, err := filepath.Abs(filepath.Join(tmpStorageFolder, LOCAL_IMAGE_FOLDER))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(imageFolder, 0755); err != nil {
+		return nil, err
+	}
+	logger.Warn("Using local sandbox, submissions will run unisolated on this host")
+	return &LocalSandbox{
+		logger:      logger,
+		imageFolder: imageFolder,
+		images:      make(map[string]*localImage),
+	}, nil
+}
+
+// parseDockerfileCommand reads the dockerfile instructions the local sandbox understands.
+func parseDockerfileCommand(dockerfilePath string) ([]string, []string, error) {
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// join continued lines first
+	var instructions []string
+	var current strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		instructions = append(instructions, current.String())
+		current.Reset()
+	}
+
+	parseForm := func(arguments string) ([]string, bool) {
+		var exec []string
+		if err := json.Unmarshal([]byte(arguments), &exec); err == nil {
+			return exec, true
+		}
+		return []string{"sh", "-c", arguments}, false
+	}
+
+	var entrypoint, cmd, env []string
+	entrypointIsExec := false
+	for _, instruction := range instructions {
+		keyword, arguments, _ := strings.Cut(instruction, " ")
+		arguments = strings.TrimSpace(arguments)
+		switch strings.ToUpper(keyword) {
+		case "ENTRYPOINT":
+			entrypoint, entrypointIsExec = parseForm(arguments)
+		case "CMD":
+			cmd, _ = parseForm(arguments)
+		case "ENV":
+			if key, value, ok := strings.Cut(arguments, "="); ok && !strings.Contains(key, " ") {
+				env = append(env, fmt.Sprintf("%s=%s", key, strings.Trim(value, `"`)))
+			} else if key, value, ok := strings.Cut(arguments, " "); ok {
+				env = append(env, fmt.Sprintf("%s=%s", key, strings.TrimSpace(value)))
+			}
+		}
+	}
+
+	command := cmd
+	if entrypoint != nil {
+		command = entrypoint
+		if entrypointIsExec {
+			command = append(command, cmd...)
+		}
+	}
+	if len(command) == 0 {
+		return nil, nil, errors.New("dockerfile has neither CMD nor ENTRYPOINT")
+	}
+	return command, env, nil
+}
+
+func replaceMountTargets(values []string, mounts []MountSpec) []string {
+	replaced := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, m := range mounts {
+			value = strings.ReplaceAll(value, m.Target, m.Source)
+		}
+		replaced = append(replaced, value)
+	}
+	return replaced
+}
+
+func (s *LocalSandbox) Build(ctx context.Context, spec *BuildSpec) (*BuildResult, error) {
+	command, env, err := parseDockerfileCommand(filepath.Join(spec.ContextPath, spec.Dockerfile))
+	if err != nil {
+		// the dockerfile is part of the submission, so this is the fault of the student
+		log := fmt.Sprintf("%s: %s\n", spec.Dockerfile, err)
+		if spec.Output != nil {
+			io.WriteString(spec.Output, log)
+		}
+		return &BuildResult{Log: log, Failed: true}, nil
+	}
+	dir := filepath.Join(s.imageFolder, spec.ImageName)
+	if err := shared.CopyDir(spec.ContextPath, dir); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.images[spec.ImageName] = &localImage{
+		dir:     dir,
+		command: command,
+		env:     env,
+	}
+	return &BuildResult{}, nil
+}
+
+func (s *LocalSandbox) Run(ctx context.Context, spec *RunSpec) (*RunResult, error) {
+	s.mutex.Lock()
+	image, ok := s.images[spec.ImageName]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("local image %s not built", spec.ImageName)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, spec.Timeout)
+	defer cancel()
+
+	command := image.command
+	if len(spec.Command) > 0 {
+		command = spec.Command
+	}
+	command = replaceMountTargets(command, spec.Mounts)
+	cmd := exec.CommandContext(runCtx, command[0], command[1:]...)
+	startProcessGroup(cmd)
+	// stop waiting for the output of processes that escaped the group
+	cmd.WaitDelay = LOCAL_WAIT_DELAY
+	cmd.Dir = image.dir
+	cmd.Env = append(os.Environ(), image.env...)
+	cmd.Env = append(cmd.Env, replaceMountTargets(spec.Env, spec.Mounts)...)
+	// last, so the env of a stage cannot move the report away from where it is read
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", REPORT_DIR_ENV_KEY, spec.ReportPath))
+	var buf bytes.Buffer
+	var output io.Writer = &buf
+	if spec.Output != nil {
+		output = io.MultiWriter(&buf, spec.Output)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if runCtx.Err() != nil {
+		return &RunResult{Log: buf.String(), TimedOut: true}, nil
+	}
+	var exitError *exec.ExitError
+	if err != nil && !errors.As(err, &exitError) {
+		return nil, err
+	}
+	// a non-zero exit code is judged by the report, just like a container that exits with an error
+	return &RunResult{Log: buf.String()}, nil
+}
+
+func (s *LocalSandbox) CleanUp(ctx context.Context, spec *RunSpec) error {
+	s.mutex.Lock()
+	image, ok := s.images[spec.ImageName]
+	delete(s.images, spec.ImageName)
+	s.mutex.Unlock()
+	if !ok {
+		// already removed by the clean up of another stage
+		return nil
+	}
+	if err := os.RemoveAll(image.dir); err != nil {
+		s.logger.Error("Failed to remove local image", zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package tester
+
+import "os/exec"
+
+// startProcessGroup is a no-op without process groups, only the direct child is killed on cancel.
+func startProcessGroup(cmd *exec.Cmd) {}
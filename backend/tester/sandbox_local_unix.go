@@ -0,0 +1,17 @@
+//go:build unix
+
+package tester
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes cancelling cmd kill everything it started,
+// a grandchild such as the test under sh -c would otherwise keep the output pipes open.
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
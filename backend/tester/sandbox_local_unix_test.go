@@ -0,0 +1,80 @@
+//go:build unix
+
+package tester
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLocalSandboxTimeoutKillsGrandchildren(t *testing.T) {
+	sandbox, err := NewLocalSandbox(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextPath := t.TempDir()
+	// the background sleep inherits the output pipes of sh
+	dockerfile := "FROM scratch\nCMD sleep 30 & sleep 30\n"
+	if err := os.WriteFile(filepath.Join(contextPath, "dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	buildResult, err := sandbox.Build(ctx, &BuildSpec{ContextPath: contextPath, Dockerfile: "dockerfile", ImageName: "image"})
+	if err != nil || buildResult.Failed {
+		t.Fatal(err, buildResult)
+	}
+	spec := &RunSpec{ImageName: "image", ReportPath: t.TempDir(), Timeout: 200 * time.Millisecond}
+	defer sandbox.CleanUp(ctx, spec)
+
+	start := time.Now()
+	runResult, err := sandbox.Run(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !runResult.TimedOut {
+		t.Error("run did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > LOCAL_WAIT_DELAY {
+		t.Errorf("run took %s, the grandchild kept it waiting", elapsed)
+	}
+}
+
+func TestLocalSandboxStageEnvKeepsReportDir(t *testing.T) {
+	sandbox, err := NewLocalSandbox(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextPath := t.TempDir()
+	dockerfile := "FROM scratch\nCMD echo true > \"$REPORT_DIR/result\"\n"
+	if err := os.WriteFile(filepath.Join(contextPath, "dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	buildResult, err := sandbox.Build(ctx, &BuildSpec{ContextPath: contextPath, Dockerfile: "dockerfile", ImageName: "image"})
+	if err != nil || buildResult.Failed {
+		t.Fatal(err, buildResult)
+	}
+	elsewhere := t.TempDir()
+	spec := &RunSpec{
+		ImageName:  "image",
+		ReportPath: t.TempDir(),
+		Timeout:    10 * time.Second,
+		Env:        []string{REPORT_DIR_ENV_KEY + "=" + elsewhere},
+	}
+	defer sandbox.CleanUp(ctx, spec)
+
+	if _, err := sandbox.Run(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(spec.ReportPath, REPORT_RESULT_FILE)); err != nil {
+		t.Errorf("report not written to the report path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(elsewhere, REPORT_RESULT_FILE)); err == nil {
+		t.Error("the env of the stage moved the report")
+	}
+}
@@ -0,0 +1,35 @@
+package tester
+
+import (
+	"fmt"
+	"judge/jConfig"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// PodmanSandbox talks to a rootless Podman service through its
+// Docker-compatible API, started with `podman system service`.
+type PodmanSandbox struct {
+	*DockerSandbox
+}
+
+func defaultPodmanSocket() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return fmt.Sprintf("unix://%s/podman/podman.sock", runtimeDir)
+}
+
+func NewPodmanSandbox(logger *zap.Logger, socketPath string, cacheConfig jConfig.ImageCacheConfig) (*PodmanSandbox, error) {
+	if socketPath == "" {
+		socketPath = defaultPodmanSocket()
+	}
+	logger.Info("Using podman sandbox", zap.String("socket", socketPath))
+	dockerSandbox, err := NewDockerSandbox(logger, socketPath, cacheConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &PodmanSandbox{DockerSandbox: dockerSandbox}, nil
+}
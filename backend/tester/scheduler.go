@@ -0,0 +1,130 @@
+package tester
+
+import (
+	"errors"
+	"fmt"
+	"judge/jConfig"
+	"judge/schema"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrUserQueueFull = errors.New("too many pending testings for this user")
+
+// Tasks are scheduled round-robin across users, so a user pushing a lot only delays themselves.
+// The next task is the oldest pending task of the user with the fewest running tasks,
+// ties going to the user who was served least recently.
+
+type pendingCandidate struct {
+	RepositoryId string
+	Serial       int32
+	CreateTime   string
+	Provider     string
+	Subject      string
+}
+
+type userLoad struct {
+	Provider     string
+	Subject      string
+	Running      int
+	LastRunStart string
+}
+
+func userKey(provider string, subject string) string {
+	return fmt.Sprintf("%s/%s", provider, subject)
+}
+
+// testingsOfUsers selects testings together with the user owning their repository.
+func testingsOfUsers(db *gorm.DB) *gorm.DB {
+	return db.Model(&schema.Testing{}).
+		Joins("JOIN repositories ON repositories.repository_id = testings.repository_id")
+}
+
+func listPendingCandidates(db *gorm.DB) ([]pendingCandidate, error) {
+	var candidates []pendingCandidate
+	err := testingsOfUsers(db).
+		Select("testings.repository_id, testings.serial, testings.create_time, repositories.provider, repositories.subject").
+		Where("testings.status = ?", StatusPending).
+		Order("testings.create_time, testings.serial").
+		Scan(&candidates).Error
+	return candidates, err
+}
+
+func listUserLoads(db *gorm.DB) (map[string]*userLoad, error) {
+	var loads []userLoad
+	err := testingsOfUsers(db).
+		Select("repositories.provider, repositories.subject, "+
+			"SUM(CASE WHEN testings.status = ? THEN 1 ELSE 0 END) AS running, "+
+			"MAX(testings.run_start_time) AS last_run_start", StatusRunning).
+		Group("repositories.provider, repositories.subject").
+		Scan(&loads).Error
+	if err != nil {
+		return nil, err
+	}
+	loadsByUser := make(map[string]*userLoad, len(loads))
+	for idx := range loads {
+		loadsByUser[userKey(loads[idx].Provider, loads[idx].Subject)] = &loads[idx]
+	}
+	return loadsByUser, nil
+}
+
+// pickNextCandidate returns nil if every user with pending tasks is at the running cap.
+func pickNextCandidate(
+	config *jConfig.JudgeConfig,
+	candidates []pendingCandidate,
+	loads map[string]*userLoad,
+) *pendingCandidate {
+	var picked *pendingCandidate
+	var pickedLoad userLoad
+	seen := make(map[string]bool)
+	// candidates are ordered oldest first, so the first one of each user is their oldest
+	for idx := range candidates {
+		candidate := &candidates[idx]
+		key := userKey(candidate.Provider, candidate.Subject)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		var load userLoad
+		if loads[key] != nil {
+			load = *loads[key]
+		}
+		if config.Testing.MaxRunningTasksPerUser > 0 && load.Running >= config.Testing.MaxRunningTasksPerUser {
+			continue
+		}
+		if picked == nil ||
+			load.Running < pickedLoad.Running ||
+			(load.Running == pickedLoad.Running && load.LastRunStart < pickedLoad.LastRunStart) {
+			picked = candidate
+			pickedLoad = load
+		}
+	}
+	return picked
+}
+
+// countPendingTasksOfUser counts the queued tasks of a user, leaving out those a new task of the
+// repository and stage would replace.
+func countPendingTasksOfUser(db *gorm.DB, repositoryRecord *schema.Repository, stage int) (int64, error) {
+	var count int64
+	err := testingsOfUsers(db).
+		Where("testings.status = ? AND repositories.provider = ? AND repositories.subject = ?",
+			StatusPending, repositoryRecord.Provider, repositoryRecord.Subject).
+		Where("NOT (testings.repository_id = ? AND testings.stage = ?)", repositoryRecord.RepositoryId, stage).
+		Count(&count).Error
+	return count, err
+}
+
+// replacePendingTasks drops the still pending tasks of the same repository and stage
+// in favor of the newer one.
+func replacePendingTasks(db *gorm.DB, record *schema.Testing) (int64, error) {
+	result := db.Model(&schema.Testing{}).
+		Where("repository_id = ? AND stage = ? AND status = ? AND serial <> ?",
+			record.RepositoryId, record.Stage, StatusPending, record.Serial).
+		Updates(map[string]interface{}{
+			"status":       StatusReplaced,
+			"message":      fmt.Sprintf("Replaced by the newer testing #%d.", record.Serial),
+			"run_end_time": time.Now().Format(time.RFC3339),
+		})
+	return result.RowsAffected, result.Error
+}
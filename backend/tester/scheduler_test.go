@@ -0,0 +1,171 @@
+package tester
+
+import (
+	"judge/jConfig"
+	"testing"
+)
+
+func TestPickNextCandidate(t *testing.T) {
+	// oldest first, alice pushed three times before bob and carol pushed once
+	candidates := []pendingCandidate{
+		{RepositoryId: "alice-repo", Serial: 1, Provider: "github", Subject: "alice"},
+		{RepositoryId: "alice-repo", Serial: 2, Provider: "github", Subject: "alice"},
+		{RepositoryId: "alice-repo", Serial: 3, Provider: "github", Subject: "alice"},
+		{RepositoryId: "bob-repo", Serial: 1, Provider: "github", Subject: "bob"},
+		{RepositoryId: "carol-repo", Serial: 1, Provider: "gitlab", Subject: "carol"},
+	}
+	tests := []struct {
+		name        string
+		maxPerUser  int
+		loads       map[string]*userLoad
+		candidates  []pendingCandidate
+		wantRepo    string
+		wantSerial  int32
+		wantNothing bool
+	}{
+		{
+			name:       "idle users go oldest first",
+			candidates: candidates,
+			wantRepo:   "alice-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "fewest running wins over oldest",
+			candidates: candidates,
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 1},
+			},
+			wantRepo:   "bob-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "ties go to the user served least recently",
+			candidates: candidates,
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 1, LastRunStart: "2026-01-01T10:00:00Z"},
+				"github/bob":   {Running: 1, LastRunStart: "2026-01-01T09:00:00Z"},
+				"gitlab/carol": {Running: 1, LastRunStart: "2026-01-01T11:00:00Z"},
+			},
+			wantRepo:   "bob-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "user at the cap is skipped",
+			maxPerUser: 1,
+			candidates: candidates[:4],
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 1},
+			},
+			wantRepo:   "bob-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "user under the cap is picked",
+			maxPerUser: 2,
+			candidates: candidates[:3],
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 1},
+			},
+			wantRepo:   "alice-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "capped user does not block the others behind it",
+			maxPerUser: 2,
+			candidates: candidates,
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 2},
+				"github/bob":   {Running: 2},
+			},
+			wantRepo:   "carol-repo",
+			wantSerial: 1,
+		},
+		{
+			name:       "every user at the cap",
+			maxPerUser: 1,
+			candidates: candidates[:4],
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 1},
+				"github/bob":   {Running: 3},
+			},
+			wantNothing: true,
+		},
+		{
+			name:       "no cap",
+			candidates: candidates[:3],
+			loads: map[string]*userLoad{
+				"github/alice": {Running: 10},
+			},
+			wantRepo:   "alice-repo",
+			wantSerial: 1,
+		},
+		{
+			name:        "nothing pending",
+			wantNothing: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &jConfig.JudgeConfig{}
+			config.Testing.MaxRunningTasksPerUser = tt.maxPerUser
+			picked := pickNextCandidate(config, tt.candidates, tt.loads)
+			if tt.wantNothing {
+				if picked != nil {
+					t.Errorf("picked %s #%d, want nothing", picked.RepositoryId, picked.Serial)
+				}
+				return
+			}
+			if picked == nil {
+				t.Fatalf("picked nothing, want %s #%d", tt.wantRepo, tt.wantSerial)
+			}
+			if picked.RepositoryId != tt.wantRepo || picked.Serial != tt.wantSerial {
+				t.Errorf("picked %s #%d, want %s #%d", picked.RepositoryId, picked.Serial, tt.wantRepo, tt.wantSerial)
+			}
+		})
+	}
+}
+
+func TestPickNextCandidateRoundRobin(t *testing.T) {
+	config := &jConfig.JudgeConfig{}
+	config.Testing.MaxRunningTasksPerUser = 2
+	remaining := []pendingCandidate{
+		{RepositoryId: "alice-repo", Serial: 1, Provider: "github", Subject: "alice"},
+		{RepositoryId: "alice-repo", Serial: 2, Provider: "github", Subject: "alice"},
+		{RepositoryId: "alice-repo", Serial: 3, Provider: "github", Subject: "alice"},
+		{RepositoryId: "bob-repo", Serial: 1, Provider: "github", Subject: "bob"},
+		{RepositoryId: "bob-repo", Serial: 2, Provider: "github", Subject: "bob"},
+	}
+	loads := make(map[string]*userLoad)
+	var order []string
+	// every picked task starts and keeps running
+	for {
+		picked := pickNextCandidate(config, remaining, loads)
+		if picked == nil {
+			break
+		}
+		order = append(order, picked.Subject)
+		key := userKey(picked.Provider, picked.Subject)
+		if loads[key] == nil {
+			loads[key] = &userLoad{Provider: picked.Provider, Subject: picked.Subject}
+		}
+		loads[key].Running++
+		for idx := range remaining {
+			if remaining[idx] == *picked {
+				remaining = append(remaining[:idx], remaining[idx+1:]...)
+				break
+			}
+		}
+	}
+	want := []string{"alice", "bob", "alice", "bob"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for idx := range want {
+		if order[idx] != want[idx] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+	if len(remaining) != 1 || remaining[0].Serial != 3 {
+		t.Errorf("left %v pending, want the third task of alice held back by the cap", remaining)
+	}
+}
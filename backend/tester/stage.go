@@ -0,0 +1,316 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// stageResult is the outcome of running the tests of one stage.
+type stageResult struct {
+	Stage    int                  `json:"stage"`
+	Status   string               `json:"status"`
+	Message  string               `json:"message"`
+	Log      string               `json:"log"`
+	Cases    []schema.TestingCase `json:"cases"`
+	Score    float64              `json:"score"`
+	MaxScore float64              `json:"maxScore"`
+}
+
+// testedStages lists the stages a task runs, every stage up to its own in regression mode.
+func testedStages(task *TestingTask) []int {
+	if !task.TestingRecord.Regression {
+		return []int{task.Stage}
+	}
+	stages := make([]int, 0, task.Stage+1)
+	for stage := 0; stage <= task.Stage; stage++ {
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// getStage returns nil for stages the challenge does not describe.
+func getStage(challengeRecord *challenge.Challenge, stage int) *challenge.Stage {
+	if stage < 0 || stage >= len(challengeRecord.Stages) {
+		return nil
+	}
+	return &challengeRecord.Stages[stage]
+}
+
+// stageMountSource resolves the source of a stage mount, which must stay inside the challenge folder.
+func stageMountSource(challengePath string, stageMount challenge.StageMount) (string, error) {
+	if !filepath.IsLocal(stageMount.Source) {
+		return "", fmt.Errorf("mount source %s is outside of the challenge", stageMount.Source)
+	}
+	source, err := filepath.Abs(filepath.Join(challengePath, stageMount.Source))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(source); err != nil {
+		return "", err
+	}
+	return source, nil
+}
+
+// requiredChallengeFiles lists the files of the challenge folder a task mounts,
+// relative to the challenge folder.
+func requiredChallengeFiles(task *TestingTask, startpoint *challenge.StartPoint) []string {
+	var files []string
+	if startpoint.TestHarness != "" {
+		files = append(files, startpoint.TestHarness)
+	}
+	for _, stage := range testedStages(task) {
+		if stageRecord := getStage(&task.Challenge, stage); stageRecord != nil {
+			for _, stageMount := range stageRecord.Mounts {
+				files = append(files, stageMount.Source)
+			}
+		}
+	}
+	return files
+}
+
+// stageRunSpec derives the spec of a single stage from the spec shared by all stages of a task,
+// applying the settings of the stage from attribute.toml.
+func stageRunSpec(
+	config *jConfig.JudgeConfig,
+	task *TestingTask,
+	runSpec *RunSpec,
+	tempStoragePath string,
+	challengePath string,
+	stage int,
+) (*RunSpec, error) {
+	spec := *runSpec
+	spec.ContainerName = fmt.Sprintf("%s-%d", runSpec.ContainerName, stage)
+	spec.Limits = resolveResourceLimits(config, &task.Challenge, stage)
+	spec.Env = nil
+	spec.Mounts = append([]MountSpec(nil), runSpec.Mounts...)
+
+	if stageRecord := getStage(&task.Challenge, stage); stageRecord != nil {
+		if stageRecord.TimeoutInSecond > 0 {
+			spec.Timeout = time.Duration(stageRecord.TimeoutInSecond) * time.Second
+		}
+		if len(stageRecord.Command) > 0 {
+			spec.Command = stageRecord.Command
+		}
+		keys := make([]string, 0, len(stageRecord.Env))
+		for key := range stageRecord.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			spec.Env = append(spec.Env, fmt.Sprintf("%s=%s", key, stageRecord.Env[key]))
+		}
+		for _, stageMount := range stageRecord.Mounts {
+			source, err := stageMountSource(challengePath, stageMount)
+			if err != nil {
+				return nil, err
+			}
+			spec.Mounts = append(spec.Mounts, MountSpec{
+				Source:   source,
+				Target:   stageMount.Target,
+				ReadOnly: true,
+			})
+		}
+	}
+	// later values win, so the stage cannot override the variables of the judge
+	spec.Env = append(spec.Env, runSpec.Env...)
+	spec.Env = append(spec.Env, fmt.Sprintf("%s=%d", STAGE_ENV_KEY, stage))
+
+	reportPath, err := filepath.Abs(filepath.Join(tempStoragePath, fmt.Sprintf("report-%d", stage)))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(reportPath, 0755); err != nil {
+		return nil, err
+	}
+	spec.ReportPath = reportPath
+	return &spec, nil
+}
+
+// stageMaxScore is the max score of a stage, also of those the challenge does not describe.
+func stageMaxScore(challengeRecord *challenge.Challenge, stage int) float64 {
+	if stageRecord := getStage(challengeRecord, stage); stageRecord != nil {
+		return stageRecord.MaxScore
+	}
+	return challenge.DEFAULT_STAGE_MAX_SCORE
+}
+
+// reportScore limits the reported score to the stage, without one a passed stage gets the max score.
+func reportScore(report *Report, maxScore float64) float64 {
+	if report.Score == nil {
+		if report.Pass {
+			return maxScore
+		}
+		return 0
+	}
+	score := *report.Score
+	if math.IsNaN(score) || score < 0 {
+		return 0
+	}
+	return math.Min(score, maxScore)
+}
+
+// runStage runs the built image for one stage.
+// Failures of the submission end up in the result, the error is only for failures of the judge.
+func runStage(
+	ctx context.Context,
+	logger *zap.Logger,
+	sandbox Sandbox,
+	spec *RunSpec,
+	stage int,
+	maxScore float64,
+) (*stageResult, error) {
+	result := &stageResult{Stage: stage, MaxScore: maxScore}
+	runResult, err := sandbox.Run(ctx, spec)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if runResult != nil {
+		result.Log = runResult.Log
+	}
+	if err != nil {
+		logger.Error("Failed to run submission", zap.Error(err), zap.Int("stage", stage))
+		result.Status = StatusError
+		return result, nil
+	}
+	if runResult.MemoryExceeded {
+		result.Status = StatusMemoryExceeded
+		return result, nil
+	}
+	if runResult.TimedOut {
+		result.Status = StatusRunningTimeout
+		return result, nil
+	}
+
+	report, err := readReport(logger, spec.ReportPath)
+	if err != nil {
+		logger.Error("Failed to read report", zap.Error(err), zap.Int("stage", stage))
+		result.Status = StatusError
+		result.Message = err.Error()
+		return result, nil
+	}
+	result.Message = report.Message
+	result.Score = reportScore(report, maxScore)
+	result.Cases = report.Cases
+	for idx := range result.Cases {
+		result.Cases[idx].Stage = int32(stage)
+	}
+	if report.Pass {
+		result.Status = StatusSuccess
+	} else {
+		result.Status = StatusFailed
+	}
+	return result, nil
+}
+
+// writeStageHeader separates the output of the stages of a regression run.
+func writeStageHeader(w io.Writer, stage int) string {
+	header := fmt.Sprintf("==> stage %d <==\n", stage)
+	if w != nil {
+		io.WriteString(w, header)
+	}
+	return header
+}
+
+// summarizeStages folds the stage results into the testing record.
+// The testing takes the status of the first stage that did not succeed.
+func summarizeStages(record *schema.Testing, results []*stageResult) {
+	record.Status = StatusSuccess
+	for _, result := range results {
+		if result.Status != StatusSuccess {
+			record.Status = result.Status
+			break
+		}
+	}
+	if !record.Regression && len(results) == 1 {
+		record.Message = results[0].Message
+		record.Log = results[0].Log
+		return
+	}
+	var message, log strings.Builder
+	for _, result := range results {
+		fmt.Fprintf(&message, "## Stage %d: %s, %g of %g points\n\n", result.Stage, result.Status, result.Score, result.MaxScore)
+		if result.Message != "" {
+			message.WriteString(strings.TrimSpace(result.Message))
+			message.WriteString("\n\n")
+		}
+		log.WriteString(writeStageHeader(nil, result.Stage))
+		log.WriteString(result.Log)
+	}
+	record.Message = message.String()
+	record.Log = log.String()
+}
+
+// saveTestingStages replaces the stage results and cases stored for a testing.
+func saveTestingStages(db *gorm.DB, record *schema.Testing, results []*stageResult) error {
+	stages := make([]schema.TestingStage, 0, len(results))
+	cases := make([]schema.TestingCase, 0)
+	for _, result := range results {
+		stages = append(stages, schema.TestingStage{
+			RepositoryId: record.RepositoryId,
+			Serial:       record.Serial,
+			Stage:        int32(result.Stage),
+			Status:       result.Status,
+			Message:      result.Message,
+			Score:        result.Score,
+			MaxScore:     result.MaxScore,
+		})
+		cases = append(cases, result.Cases...)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("repository_id = ? AND serial = ?", record.RepositoryId, record.Serial).
+			Delete(&schema.TestingStage{}).Error
+		if err != nil {
+			return err
+		}
+		if len(stages) == 0 {
+			return nil
+		}
+		return tx.Create(&stages).Error
+	})
+	if err != nil {
+		return err
+	}
+	return saveTestingCases(db, record, cases)
+}
+
+// saveBestScores keeps the best score the repository got for each stage run by a testing.
+func saveBestScores(db *gorm.DB, record *schema.Testing, results []*stageResult) error {
+	now := time.Now().Format(time.RFC3339)
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, result := range results {
+			var best schema.RepositoryStageScore
+			found := tx.Where("repository_id = ? AND stage = ?", record.RepositoryId, result.Stage).
+				Limit(1).Find(&best)
+			if found.Error != nil {
+				return found.Error
+			}
+			if found.RowsAffected == 1 && best.Score >= result.Score {
+				continue
+			}
+			best = schema.RepositoryStageScore{
+				RepositoryId: record.RepositoryId,
+				Stage:        int32(result.Stage),
+				Score:        result.Score,
+				Serial:       record.Serial,
+				UpdateTime:   now,
+			}
+			if err := tx.Save(&best).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
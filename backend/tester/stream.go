@@ -0,0 +1,227 @@
+package tester
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"judge/jConfig"
+	"judge/router"
+	"judge/schema"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const LOG_SUBSCRIBER_BUFFER_SIZE = 64
+
+// logBroadcaster collects the output of a running task and fans it out to stream subscribers.
+type logBroadcaster struct {
+	mutex       sync.Mutex
+	history     bytes.Buffer
+	subscribers map[chan []byte]bool
+	closed      bool
+}
+
+func (b *logBroadcaster) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.history.Write(p)
+	chunk := append([]byte(nil), p...)
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- chunk:
+		default:
+			// the subscriber is too slow, it may replay the stored log later
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the output so far and a channel for what follows.
+// The channel is nil if the task has already finished.
+func (b *logBroadcaster) subscribe() ([]byte, chan []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	history := append([]byte(nil), b.history.Bytes()...)
+	if b.closed {
+		return history, nil
+	}
+	subscriber := make(chan []byte, LOG_SUBSCRIBER_BUFFER_SIZE)
+	b.subscribers[subscriber] = true
+	return history, subscriber
+}
+
+func (b *logBroadcaster) unsubscribe(subscriber chan []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[subscriber] {
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+func (b *logBroadcaster) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for subscriber := range b.subscribers {
+		close(subscriber)
+	}
+	b.subscribers = nil
+}
+
+var liveLogs = struct {
+	mutex        sync.Mutex
+	broadcasters map[string]*logBroadcaster
+}{
+	broadcasters: make(map[string]*logBroadcaster),
+}
+
+func openLiveLog(record *schema.Testing) *logBroadcaster {
+	liveLogs.mutex.Lock()
+	defer liveLogs.mutex.Unlock()
+	broadcaster := &logBroadcaster{
+		subscribers: make(map[chan []byte]bool),
+	}
+	liveLogs.broadcasters[runningTaskKey(record.RepositoryId, record.Serial)] = broadcaster
+	return broadcaster
+}
+
+func closeLiveLog(record *schema.Testing) {
+	liveLogs.mutex.Lock()
+	key := runningTaskKey(record.RepositoryId, record.Serial)
+	broadcaster, ok := liveLogs.broadcasters[key]
+	delete(liveLogs.broadcasters, key)
+	liveLogs.mutex.Unlock()
+	if ok {
+		broadcaster.close()
+	}
+}
+
+func findLiveLog(repositoryId string, serial int32) *logBroadcaster {
+	liveLogs.mutex.Lock()
+	defer liveLogs.mutex.Unlock()
+	return liveLogs.broadcasters[runningTaskKey(repositoryId, serial)]
+}
+
+func writeServerSentEvent(w *bufio.Writer, event string, data string) error {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+	return w.Flush()
+}
+
+// streamTestingLog writes the output of a testing as server sent events.
+// "log" events carry output, the final "end" event carries the status the testing ended with.
+func streamTestingLog(
+	logger *zap.Logger,
+	db *gorm.DB,
+	w *bufio.Writer,
+	repositoryId string,
+	serial int32,
+) {
+	for {
+		if broadcaster := findLiveLog(repositoryId, serial); broadcaster != nil {
+			history, subscriber := broadcaster.subscribe()
+			if len(history) > 0 {
+				if err := writeServerSentEvent(w, "log", string(history)); err != nil {
+					broadcaster.unsubscribe(subscriber)
+					return
+				}
+			}
+			for subscriber != nil {
+				chunk, ok := <-subscriber
+				if !ok {
+					break
+				}
+				if err := writeServerSentEvent(w, "log", string(chunk)); err != nil {
+					broadcaster.unsubscribe(subscriber)
+					return
+				}
+			}
+			var record schema.Testing
+			if err := db.Where("repository_id = ? AND serial = ?", repositoryId, serial).First(&record).Error; err != nil {
+				logger.Error("Failed to get testing record", zap.Error(err))
+				return
+			}
+			if record.Status == StatusRunning {
+				// dropped for being too slow, the client may reconnect
+				return
+			}
+			writeServerSentEvent(w, "end", record.Status)
+			return
+		}
+
+		var record schema.Testing
+		if err := db.Where("repository_id = ? AND serial = ?", repositoryId, serial).First(&record).Error; err != nil {
+			logger.Error("Failed to get testing record", zap.Error(err))
+			writeServerSentEvent(w, "end", StatusError)
+			return
+		}
+		if record.Status != StatusPending && record.Status != StatusRunning {
+			// finished, replay what was stored
+			if record.BuildLog != "" {
+				if err := writeServerSentEvent(w, "log", record.BuildLog); err != nil {
+					return
+				}
+			}
+			if record.Log != "" {
+				if err := writeServerSentEvent(w, "log", record.Log); err != nil {
+					return
+				}
+			}
+			writeServerSentEvent(w, "end", record.Status)
+			return
+		}
+		// still queued, keep the connection alive until it starts
+		fmt.Fprintf(w, ": %s\n\n", record.Status)
+		if err := w.Flush(); err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func BuildStreamTestingHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		repositoryId := c.Params("repo")
+		serial, err := c.ParamsInt("serial", -1)
+		if err != nil || serial < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Invalid serial",
+			))
+		}
+
+		_, ferr := findOwnedRepository(logger, db, c, repositoryId)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+
+		var testingRecord schema.Testing
+		if err := db.Where("repository_id = ? AND serial = ?", repositoryId, serial).First(&testingRecord).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Testing not found",
+			))
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			streamTestingLog(logger, db, w, repositoryId, int32(serial))
+		})
+		return nil
+	}
+}
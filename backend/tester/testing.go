@@ -1,14 +1,16 @@
 package tester
 
 import (
+	"errors"
+	"io"
 	"judge/challenge"
 	"judge/jConfig"
 	"judge/middleware"
 	"judge/router"
 	"judge/schema"
+	"judge/shared"
 	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -22,39 +24,86 @@ const (
 	StatusError          = "error"
 	StatusWaitingTimeout = "waitingTimeout"
 	StatusRunningTimeout = "runningTimeout"
+	StatusCancelled      = "cancelled"
+	StatusMemoryExceeded = "memoryExceeded"
+	StatusBuildFailed    = "buildFailed"
+	StatusReplaced       = "replaced"
 )
 
+var ErrPendingQueueFull = errors.New("pending queue is full")
+var ErrRepositoryReadOnly = errors.New("repository is archived or deleted")
+
 type TestingTask struct {
 	RepositoryId     string
 	Serial           int
 	Stage            int
 	Challenge        challenge.Challenge
+	Repository       schema.Repository
 	TestingRecord    *schema.Testing
 	WaitingStartTime time.Time
+	// receives the output while the task runs
+	LiveLog io.Writer
 }
 
-func pushToPending(
+// PushToPending queues a testing of the commit, HEAD if it is empty.
+// Regression defaults to the setting of the challenge if it is nil.
+// Pending testings of the same repository and stage are replaced by the new one.
+// The caller is responsible for checking that the repository belongs to the user.
+func PushToPending(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
 	db *gorm.DB,
 	repositoryId string,
 	stage int,
-) error {
+	commit string,
+	regression *bool,
+) (*schema.Testing, error) {
+	// the commit is resolved and the testing queued while no reset rewrites the files
+	defer LockRepository(repositoryId)()
 	repositoryRecord := &schema.Repository{}
 	err := db.Where("repository_id = ?", repositoryId).First(repositoryRecord).Error
 	if err != nil {
 		logger.Error("Failed to get repository record", zap.Error(err))
-		return err
+		return nil, err
+	}
+	if repositoryRecord.ArchiveTime != "" || repositoryRecord.DeleteTime != "" {
+		return nil, ErrRepositoryReadOnly
+	}
+	// pin the commit now, later pushes must not change what gets tested
+	commit, err = shared.ResolveCommit(GetRepositoryPath(config, repositoryRecord), commit)
+	if err != nil {
+		logger.Error("Failed to resolve commit", zap.Error(err))
+		return nil, err
 	}
 	folderName := repositoryRecord.ChallengeFolderName
-	challengeRecord, err := challenge.ParseChallenge(
-		logger,
-		&config.Challenge,
-		folderName,
-	)
+	// look it up early so a broken challenge is reported to the user instead of the listener
+	challengeRecord, err := challenge.GetCatalog(logger, &config.Challenge).Get(folderName)
 	if err != nil {
-		logger.Error("Failed to parse challenge", zap.Error(err))
-		return err
+		logger.Error("Failed to get challenge", zap.Error(err))
+		return nil, err
+	}
+	pendingCount, err := countPendingTasks(db)
+	if err != nil {
+		logger.Error("Failed to count pending tasks", zap.Error(err))
+		return nil, err
+	}
+	if config.Testing.PendingQueueSize > 0 && pendingCount >= int64(config.Testing.PendingQueueSize) {
+		logger.Warn("Pending queue is full", zap.Int64("pending", pendingCount))
+		return nil, ErrPendingQueueFull
+	}
+	if config.Testing.MaxPendingTasksPerUser > 0 {
+		userPendingCount, err := countPendingTasksOfUser(db, repositoryRecord, stage)
+		if err != nil {
+			logger.Error("Failed to count pending tasks of user", zap.Error(err))
+			return nil, err
+		}
+		if userPendingCount >= int64(config.Testing.MaxPendingTasksPerUser) {
+			logger.Warn("Pending tasks of user exceeded",
+				zap.String("provider", repositoryRecord.Provider),
+				zap.String("subject", repositoryRecord.Subject),
+				zap.Int64("pending", userPendingCount))
+			return nil, ErrUserQueueFull
+		}
 	}
 	var repositoryTestingSerial schema.RepositoryTestingSerial
 	err = db.Where("repository_id = ?", repositoryId).First(&repositoryTestingSerial).Error
@@ -66,7 +115,7 @@ func pushToPending(
 		err = db.Save(&repositoryTestingSerial).Error
 		if err != nil {
 			logger.Error("Failed to create repository testing serial", zap.Error(err))
-			return err
+			return nil, err
 		}
 	}
 	serial := repositoryTestingSerial.NextSerial
@@ -75,31 +124,69 @@ func pushToPending(
 	err = db.Save(&repositoryTestingSerial).Error
 	if err != nil {
 		logger.Error("Failed to update repository testing serial", zap.Error(err))
-		return err
+		return nil, err
 	}
 
-	testingQueue := GetTestingQueue(config)
 	testingRecord := schema.Testing{
 		RepositoryId: repositoryId,
 		Serial:       int32(serial),
 		Stage:        int32(stage),
+		Commit:       commit,
+		Regression:   challengeRecord.Regression,
 		Status:       StatusPending,
 		CreateTime:   time.Now().Format(time.RFC3339),
 	}
+	if regression != nil {
+		testingRecord.Regression = *regression
+	}
 	err = db.Save(&testingRecord).Error
 	if err != nil {
 		logger.Error("Failed to create testing record", zap.Error(err))
-		return err
+		return nil, err
+	}
+	replaced, err := replacePendingTasks(db, &testingRecord)
+	if err != nil {
+		logger.Error("Failed to replace pending tasks", zap.Error(err))
+		return nil, err
+	}
+	if replaced > 0 {
+		logger.Debug("Replaced pending tasks", zap.String("repository_id", repositoryId), zap.Int64("replaced", replaced))
+	}
+	GetTestingQueue(config).Notify()
+	return &testingRecord, nil
+}
+
+// findOwnedRepository loads the repository and checks it belongs to the authorized user.
+func findOwnedRepository(
+	logger *zap.Logger,
+	db *gorm.DB,
+	c *fiber.Ctx,
+	repositoryId string,
+) (*schema.Repository, *fiber.Error) {
+	repositoryRecord := &schema.Repository{}
+	err := db.Where("repository_id = ?", repositoryId).First(repositoryRecord).Error
+	if err != nil {
+		logger.Error("Failed to get repository record", zap.Error(err))
+		return nil, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: "Failed to get repository record",
+		}
 	}
-	testingQueue.PendingQueue <- TestingTask{
-		RepositoryId:     repositoryId,
-		Serial:           serial,
-		Stage:            stage,
-		Challenge:        *challengeRecord,
-		TestingRecord:    &testingRecord,
-		WaitingStartTime: time.Now(),
+	if repositoryRecord.Provider != c.Locals(middleware.PROVIDER_LOCAL_KEY).(string) {
+		logger.Error("Repository ID mismatch", zap.String("repository_id", repositoryId))
+		return nil, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Repository ID mismatch",
+		}
+	}
+	if repositoryRecord.Subject != c.Locals(middleware.SUBJECT_LOCAL_KEY).(string) {
+		logger.Error("Subject mismatch", zap.String("repository_id", repositoryId))
+		return nil, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Subject mismatch",
+		}
 	}
-	return nil
+	return repositoryRecord, nil
 }
 
 func BuildPushToPendingHandler(
@@ -110,33 +197,42 @@ func BuildPushToPendingHandler(
 	return func(c *fiber.Ctx) error {
 		repositoryId := c.Query("repo")
 		stage := c.QueryInt("stage", -1)
-
-		repositoryRecord := &schema.Repository{}
-		err := db.Where("repository_id = ?", repositoryId).First(repositoryRecord).Error
-		if err != nil {
-			logger.Error("Failed to get repository record", zap.Error(err))
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"message": "Failed to get repository record",
-				"error":   err.Error(),
-			})
-		}
-		if repositoryRecord.Provider != c.Locals(middleware.PROVIDER_LOCAL_KEY).(string) {
-			logger.Error("Repository ID mismatch", zap.String("repository_id", repositoryId))
-			return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError(
-				"Repository ID mismatch",
-			))
+		commit := c.Query("commit")
+		var regression *bool
+		if c.Query("regression") != "" {
+			value := c.QueryBool("regression")
+			regression = &value
 		}
-		if repositoryRecord.Subject != c.Locals(middleware.SUBJECT_LOCAL_KEY).(string) {
-			logger.Error("Subject mismatch", zap.String("repository_id", repositoryId))
-			return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError(
-				"Subject mismatch",
-			))
+
+		repositoryRecord, ferr := findOwnedRepository(logger, db, c, repositoryId)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
 		}
 		if stage == -1 {
 			stage = int(repositoryRecord.Stage)
 		}
 
-		err = pushToPending(logger, config, db, repositoryId, stage)
+		testingRecord, err := PushToPending(logger, config, db, repositoryId, stage, commit, regression)
+		if errors.Is(err, shared.ErrCommitNotFound) {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Commit not found",
+			))
+		}
+		if errors.Is(err, ErrUserQueueFull) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(router.BuildError(
+				"Too many pending testings, wait for them to finish",
+			))
+		}
+		if errors.Is(err, ErrRepositoryReadOnly) {
+			return c.Status(fiber.StatusForbidden).JSON(router.BuildError(
+				"Repository is archived or deleted",
+			))
+		}
+		if errors.Is(err, ErrPendingQueueFull) {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(router.BuildError(
+				"Pending queue is full, try again later",
+			))
+		}
 		if err != nil {
 			logger.Error("Failed to push to pending", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
@@ -146,8 +242,62 @@ func BuildPushToPendingHandler(
 		return c.Status(fiber.StatusOK).JSON(router.BuildResponse(
 			struct {
 				Message string `json:"message"`
+				Serial  int32  `json:"serial"`
+				Commit  string `json:"commit"`
 			}{
 				Message: "Successfully pushed to pending",
+				Serial:  testingRecord.Serial,
+				Commit:  testingRecord.Commit,
+			},
+		))
+	}
+}
+
+func BuildCancelTestingHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		repositoryId := c.Params("repo")
+		serial, err := c.ParamsInt("serial", -1)
+		if err != nil || serial < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Invalid serial",
+			))
+		}
+
+		_, ferr := findOwnedRepository(logger, db, c, repositoryId)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+
+		testingRecord, err := CancelTesting(logger, db, repositoryId, int32(serial))
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Testing not found",
+			))
+		}
+		if errors.Is(err, ErrTestingNotCancellable) {
+			return c.Status(fiber.StatusConflict).JSON(router.BuildError(
+				"Testing is neither pending nor running",
+			))
+		}
+		if err != nil {
+			logger.Error("Failed to cancel testing", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to cancel testing",
+			))
+		}
+		return c.Status(fiber.StatusOK).JSON(router.BuildResponse(
+			struct {
+				RepositoryId string `json:"repositoryId"`
+				Serial       int32  `json:"serial"`
+				Status       string `json:"status"`
+			}{
+				RepositoryId: testingRecord.RepositoryId,
+				Serial:       testingRecord.Serial,
+				Status:       testingRecord.Status,
 			},
 		))
 	}
@@ -157,12 +307,27 @@ func SetupTestingRouter(
 	logger *zap.Logger,
 	config *jConfig.JudgeConfig,
 	db *gorm.DB,
-	docker *client.Client,
+	sandbox Sandbox,
 	group *fiber.Router,
 ) {
 	(*group).Post(
 		"/pending",
-		middleware.BuildAuthorizationMiddleWare(logger, config, db),
+		middleware.BuildScopedAuthorizationMiddleWare(logger, config, db, middleware.TOKEN_SCOPE_TESTING),
 		BuildPushToPendingHandler(logger, config, db),
 	)
+	(*group).Get(
+		"/:repo/:serial/stream",
+		middleware.BuildScopedAuthorizationMiddleWare(logger, config, db, middleware.TOKEN_SCOPE_TESTING),
+		BuildStreamTestingHandler(logger, config, db),
+	)
+	(*group).Get(
+		"/:repo/:serial/queue",
+		middleware.BuildScopedAuthorizationMiddleWare(logger, config, db, middleware.TOKEN_SCOPE_TESTING),
+		BuildQueueStatusHandler(logger, config, db),
+	)
+	(*group).Delete(
+		"/:repo/:serial",
+		middleware.BuildScopedAuthorizationMiddleWare(logger, config, db, middleware.TOKEN_SCOPE_TESTING),
+		BuildCancelTestingHandler(logger, config, db),
+	)
 }
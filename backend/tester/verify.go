@@ -0,0 +1,136 @@
+package tester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"judge/shared"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// VERIFY_REPOSITORY_ID names the runs of reference solutions, which belong to no repository.
+const VERIFY_REPOSITORY_ID = "verify"
+
+var ErrNoStages = errors.New("the challenge has no stages")
+
+// verifyStartPoint runs the reference solution of a startpoint through every stage, like a regression testing.
+func verifyStartPoint(
+	ctx context.Context,
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	sandbox Sandbox,
+	challengeRecord *challenge.Challenge,
+	startpoint *challenge.StartPoint,
+	fingerprint string,
+	output io.Writer,
+) ([]schema.StartpointVerification, error) {
+	lastStage := len(challengeRecord.Stages) - 1
+	task := &TestingTask{
+		RepositoryId: VERIFY_REPOSITORY_ID,
+		Stage:        lastStage,
+		Challenge:    *challengeRecord,
+		Repository: schema.Repository{
+			RepositoryId:        VERIFY_REPOSITORY_ID,
+			Provider:            VERIFY_REPOSITORY_ID,
+			Subject:             VERIFY_REPOSITORY_ID,
+			ChallengeFolderName: challengeRecord.FolderName,
+			Startpoint:          startpoint.Name,
+		},
+		TestingRecord: &schema.Testing{
+			RepositoryId: VERIFY_REPOSITORY_ID,
+			Stage:        int32(lastStage),
+			Regression:   true,
+		},
+		LiveLog: output,
+	}
+	challengePath := filepath.Join(config.Challenge.StorageFolder, challengeRecord.FolderName)
+	outcome, err := executeTask(ctx, logger, config, sandbox, task, func(sourcePath string) error {
+		if err := shared.CopyDir(filepath.Join(challengePath, startpoint.Root), sourcePath); err != nil {
+			return err
+		}
+		return shared.CopyDir(filepath.Join(challengePath, startpoint.ReferenceSolution), sourcePath)
+	}, challengePath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	verifications := make([]schema.StartpointVerification, 0, len(challengeRecord.Stages))
+	for stage := 0; stage <= lastStage; stage++ {
+		verification := schema.StartpointVerification{
+			ChallengeFolderName: challengeRecord.FolderName,
+			Startpoint:          startpoint.Name,
+			Stage:               int32(stage),
+			Status:              StatusBuildFailed,
+			Message:             outcome.BuildLog,
+			VerifyTime:          now,
+			Fingerprint:         fingerprint,
+		}
+		if !outcome.BuildFailed && stage < len(outcome.Results) {
+			verification.Status = outcome.Results[stage].Status
+			verification.Message = outcome.Results[stage].Message
+		}
+		verifications = append(verifications, verification)
+	}
+	return verifications, nil
+}
+
+// VerifyChallenge runs the reference solution of every startpoint that has one,
+// and stores the results, see StartpointVerification.
+// The output of the runs is written to output, which may be nil.
+func VerifyChallenge(
+	ctx context.Context,
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	sandbox Sandbox,
+	challengeRecord *challenge.Challenge,
+	output io.Writer,
+) ([]schema.StartpointVerification, error) {
+	if len(challengeRecord.Stages) == 0 {
+		return nil, ErrNoStages
+	}
+	// taken before the runs, an edit while they run makes the results stale
+	fingerprint, err := challenge.Fingerprint(&config.Challenge, challengeRecord.FolderName)
+	if err != nil {
+		return nil, err
+	}
+	verifications := make([]schema.StartpointVerification, 0)
+	for idx := range challengeRecord.StartPoints {
+		startpoint := &challengeRecord.StartPoints[idx]
+		if startpoint.ReferenceSolution == "" {
+			logger.Warn("Startpoint has no reference solution", zap.String("startpoint", startpoint.Name))
+			continue
+		}
+		if output != nil {
+			fmt.Fprintf(output, "==> startpoint %s <==\n", startpoint.Name)
+		}
+		results, err := verifyStartPoint(ctx, logger, config, sandbox, challengeRecord, startpoint, fingerprint, output)
+		if err != nil {
+			logger.Error("Failed to verify startpoint", zap.String("startpoint", startpoint.Name), zap.Error(err))
+			return nil, err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Where("challenge_folder_name = ? AND startpoint = ?", challengeRecord.FolderName, startpoint.Name).
+				Delete(&schema.StartpointVerification{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Create(&results).Error
+		})
+		if err != nil {
+			logger.Error("Failed to save verification", zap.Error(err))
+			return nil, err
+		}
+		verifications = append(verifications, results...)
+	}
+	return verifications, nil
+}
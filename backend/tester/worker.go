@@ -0,0 +1,343 @@
+package tester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"judge/jConfig"
+	"judge/router"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"go.uber.org/zap"
+)
+
+const LOG_FLUSH_INTERVAL = 500 * time.Millisecond
+const WORKER_REQUEST_TIMEOUT = 5 * time.Minute
+
+var ErrLeaseLost = errors.New("lease lost")
+
+// workerClient talks to the worker API of the server, see SetupWorkerRouter.
+type workerClient struct {
+	serverUrl string
+	token     string
+	owner     string
+	capacity  int
+	http      *http.Client
+}
+
+// do sends a request and decodes the data of the response into data, if given.
+// It returns the response body instead for non-JSON responses.
+func (w *workerClient) do(
+	ctx context.Context,
+	method string,
+	path string,
+	contentType string,
+	body io.Reader,
+	data interface{},
+) (int, []byte, error) {
+	request, err := http.NewRequestWithContext(ctx, method, w.serverUrl+"/worker"+path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+w.token)
+	request.Header.Set(LEASE_OWNER_HEADER, w.owner)
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := w.http.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, nil, err
+	}
+	if response.StatusCode == http.StatusConflict {
+		return response.StatusCode, nil, ErrLeaseLost
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		var wrapper router.Wrapper
+		if json.Unmarshal(content, &wrapper) == nil && wrapper.ErrorMessage != "" {
+			return response.StatusCode, nil, fmt.Errorf("%s %s: %s", method, path, wrapper.ErrorMessage)
+		}
+		return response.StatusCode, nil, fmt.Errorf("%s %s: status %d", method, path, response.StatusCode)
+	}
+	if data != nil && response.StatusCode != http.StatusNoContent {
+		wrapper := router.Wrapper{Data: data}
+		if err := json.Unmarshal(content, &wrapper); err != nil {
+			return response.StatusCode, nil, err
+		}
+	}
+	return response.StatusCode, content, nil
+}
+
+func (w *workerClient) post(ctx context.Context, path string, request interface{}, data interface{}) (int, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+	status, _, err := w.do(ctx, http.MethodPost, path, "application/json", bytes.NewReader(body), data)
+	return status, err
+}
+
+// lease returns nil if the server has no task to run.
+func (w *workerClient) lease(ctx context.Context) (*workerJob, error) {
+	var job workerJob
+	status, err := w.post(ctx, "/lease", leaseRequest{Owner: w.owner, Capacity: w.capacity}, &job)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// download extracts a gzipped tar served by the server into dest.
+func (w *workerClient) download(ctx context.Context, path string, dest string) error {
+	_, content, err := w.do(ctx, http.MethodGet, path, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	return archive.Untar(bytes.NewReader(content), dest, &archive.TarOptions{NoLchown: true})
+}
+
+// remoteLog buffers the output of a task and sends it to the server periodically.
+type remoteLog struct {
+	client  *workerClient
+	logger  *zap.Logger
+	path    string
+	mutex   sync.Mutex
+	buffer  bytes.Buffer
+	done    chan bool
+	stopped sync.WaitGroup
+}
+
+func newRemoteLog(logger *zap.Logger, client *workerClient, jobPath string) *remoteLog {
+	l := &remoteLog{
+		client: client,
+		logger: logger,
+		path:   jobPath + "/log",
+		done:   make(chan bool),
+	}
+	l.stopped.Add(1)
+	go func() {
+		defer l.stopped.Done()
+		ticker := time.NewTicker(LOG_FLUSH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				l.flush()
+				return
+			case <-ticker.C:
+				l.flush()
+			}
+		}
+	}()
+	return l
+}
+
+func (l *remoteLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.Write(p)
+}
+
+func (l *remoteLog) flush() {
+	l.mutex.Lock()
+	if l.buffer.Len() == 0 {
+		l.mutex.Unlock()
+		return
+	}
+	content := append([]byte(nil), l.buffer.Bytes()...)
+	l.buffer.Reset()
+	l.mutex.Unlock()
+	_, _, err := l.client.do(context.Background(), http.MethodPost, l.path, "text/plain", bytes.NewReader(content), nil)
+	if err != nil {
+		// the log is only for live viewers, the outcome carries the full one
+		l.logger.Warn("Failed to send log", zap.Error(err))
+	}
+}
+
+// close sends whatever is left.
+func (l *remoteLog) close() {
+	close(l.done)
+	l.stopped.Wait()
+}
+
+// startRemoteHeartbeat keeps the lease of a job until the returned function is called.
+// It calls cancel once the job got cancelled or the lease was lost.
+func startRemoteHeartbeat(
+	logger *zap.Logger,
+	client *workerClient,
+	jobPath string,
+	interval time.Duration,
+	cancel context.CancelFunc,
+) func() {
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var response heartbeatResponse
+				_, err := client.post(context.Background(), jobPath+"/heartbeat", struct{}{}, &response)
+				if errors.Is(err, ErrLeaseLost) {
+					logger.Warn("Lease lost", zap.String("job", jobPath))
+					cancel()
+					return
+				}
+				if err != nil {
+					// the server may be restarting, the lease survives a few missed heartbeats
+					logger.Error("Failed to extend lease", zap.Error(err))
+					continue
+				}
+				if response.Cancelled {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// runJob runs a leased job and reports its outcome, unless it got cancelled.
+func runJob(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	sandbox Sandbox,
+	client *workerClient,
+	job *workerJob,
+) {
+	jobPath := fmt.Sprintf("/%s/%d", job.Testing.RepositoryId, job.Testing.Serial)
+	task := &TestingTask{
+		RepositoryId:  job.Testing.RepositoryId,
+		Serial:        int(job.Testing.Serial),
+		Stage:         int(job.Testing.Stage),
+		Challenge:     job.Challenge,
+		Repository:    job.Repository,
+		TestingRecord: &job.Testing,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heartbeatInterval := time.Duration(job.LeaseTimeoutInSecond) * time.Second / 3
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = leaseTimeout(config) / 3
+	}
+	stopHeartbeat := startRemoteHeartbeat(logger, client, jobPath, heartbeatInterval, cancel)
+	liveLog := newRemoteLog(logger, client, jobPath)
+	task.LiveLog = liveLog
+
+	outcome, err := executeRemoteTask(ctx, logger, config, sandbox, client, task, jobPath)
+	liveLog.close()
+	// the lease only has to outlive the result, which the server answers right away
+	stopHeartbeat()
+	if ctx.Err() != nil {
+		logger.Info("Job cancelled", zap.String("job", jobPath))
+		return
+	}
+	result := resultRequest{Outcome: outcome}
+	if err != nil {
+		logger.Error("Failed to run job", zap.String("job", jobPath), zap.Error(err))
+		result = resultRequest{Error: err.Error()}
+	}
+	if _, err := client.post(context.Background(), jobPath+"/result", result, nil); err != nil {
+		logger.Error("Failed to send result", zap.String("job", jobPath), zap.Error(err))
+	}
+}
+
+// executeRemoteTask downloads the source of a job and the files of the challenge it mounts, and runs it.
+func executeRemoteTask(
+	ctx context.Context,
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	sandbox Sandbox,
+	client *workerClient,
+	task *TestingTask,
+	jobPath string,
+) (*taskOutcome, error) {
+	startpoint, err := getStartPoint(&task.Challenge, task.Repository.Startpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Testing.TmpStorageFolder, 0755); err != nil {
+		return nil, err
+	}
+	jobFolder, err := os.MkdirTemp(config.Testing.TmpStorageFolder, "job-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(jobFolder)
+	challengePath := filepath.Join(jobFolder, "challenge")
+	if startpoint != nil && len(requiredChallengeFiles(task, startpoint)) > 0 {
+		if err := client.download(ctx, jobPath+"/challenge", challengePath); err != nil {
+			return nil, err
+		}
+	}
+	return executeTask(ctx, logger, config, sandbox, task, func(sourcePath string) error {
+		return client.download(ctx, jobPath+"/source", sourcePath)
+	}, challengePath)
+}
+
+// StartWorker runs tasks leased from a remote server, up to MaxConcurrentWorkers at a time.
+func StartWorker(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	sandbox Sandbox,
+) {
+	client := &workerClient{
+		serverUrl: strings.TrimSuffix(config.Worker.ServerUrl, "/"),
+		token:     config.Worker.Token,
+		owner:     newLeaseOwner(),
+		http:      &http.Client{Timeout: WORKER_REQUEST_TIMEOUT},
+	}
+	workers := config.Testing.MaxConcurrentWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	client.capacity = workers
+	semaphore := make(chan bool, workers)
+	for idx := 0; idx < workers; idx++ {
+		semaphore <- true
+	}
+	logger.Info("Worker started",
+		zap.String("server_url", client.serverUrl),
+		zap.String("lease_owner", client.owner),
+		zap.Int("workers", workers))
+
+	for {
+		<-semaphore
+		job, err := client.lease(context.Background())
+		if err != nil {
+			logger.Error("Failed to lease task", zap.Error(err))
+		}
+		if job == nil {
+			semaphore <- true
+			time.Sleep(pollInterval(config))
+			continue
+		}
+		logger.Info("Got job",
+			zap.String("repository_id", job.Testing.RepositoryId),
+			zap.Int32("serial", job.Testing.Serial),
+			zap.Int32("stage", job.Testing.Stage))
+		go func() {
+			defer func() { semaphore <- true }()
+			runJob(logger, config, sandbox, client, job)
+		}()
+	}
+}
@@ -0,0 +1,423 @@
+package tester
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/router"
+	"judge/schema"
+	"judge/shared"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Remote workers run tasks on their own hosts and talk to the server over HTTP.
+// A worker leases a task, downloads the tested commit and the files of the challenge it mounts,
+// sends the output while running, heartbeats to keep its lease, and finally posts the outcome.
+// Leases of workers that stop heartbeating are reclaimed like those of the listener.
+
+const LEASE_OWNER_HEADER = "X-Lease-Owner"
+
+// workerJob is the response to a lease request.
+type workerJob struct {
+	Testing              schema.Testing      `json:"testing"`
+	Repository           schema.Repository   `json:"repository"`
+	Challenge            challenge.Challenge `json:"challenge"`
+	LeaseTimeoutInSecond int                 `json:"leaseTimeoutInSecond"`
+}
+
+type leaseRequest struct {
+	Owner string `json:"owner"`
+	// the number of tasks the worker runs at a time
+	Capacity int `json:"capacity"`
+}
+
+type heartbeatResponse struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+type remoteWorker struct {
+	capacity int
+	lastSeen time.Time
+}
+
+// remoteWorkers are the workers that leased or heartbeated recently, by lease owner.
+var remoteWorkers = struct {
+	sync.Mutex
+	owners map[string]*remoteWorker
+}{owners: make(map[string]*remoteWorker)}
+
+// seeRemoteWorker records that a worker is alive, capacity <= 0 keeps the known capacity.
+func seeRemoteWorker(owner string, capacity int) {
+	remoteWorkers.Lock()
+	defer remoteWorkers.Unlock()
+	worker, ok := remoteWorkers.owners[owner]
+	if !ok {
+		worker = &remoteWorker{capacity: 1}
+		remoteWorkers.owners[owner] = worker
+	}
+	if capacity > 0 {
+		worker.capacity = capacity
+	}
+	worker.lastSeen = time.Now()
+}
+
+// remoteWorkerCapacity sums the capacity of the workers seen within the lease timeout.
+func remoteWorkerCapacity(config *jConfig.JudgeConfig) int {
+	remoteWorkers.Lock()
+	defer remoteWorkers.Unlock()
+	capacity := 0
+	for owner, worker := range remoteWorkers.owners {
+		if time.Since(worker.lastSeen) > leaseTimeout(config) {
+			delete(remoteWorkers.owners, owner)
+			continue
+		}
+		capacity += worker.capacity
+	}
+	return capacity
+}
+
+// resultRequest carries the outcome of a task, or the error that kept the worker from producing one.
+type resultRequest struct {
+	Outcome *taskOutcome `json:"outcome"`
+	Error   string       `json:"error"`
+}
+
+func buildWorkerAuthorizationMiddleWare(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if config.Testing.WorkerToken == "" {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Remote workers are disabled",
+			))
+		}
+		token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Testing.WorkerToken)) != 1 {
+			logger.Warn("Invalid worker token", zap.String("ip", c.IP()))
+			return c.Status(fiber.StatusUnauthorized).JSON(router.BuildError(
+				"Invalid worker token",
+			))
+		}
+		return c.Next()
+	}
+}
+
+// findLeasedTesting loads the running testing of the path that is leased to the requesting worker.
+func findLeasedTesting(db *gorm.DB, c *fiber.Ctx) (*schema.Testing, *fiber.Error) {
+	owner := c.Get(LEASE_OWNER_HEADER)
+	serial, err := c.ParamsInt("serial", -1)
+	if err != nil || serial < 0 || owner == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid serial or lease owner")
+	}
+	var record schema.Testing
+	result := db.Where("repository_id = ? AND serial = ? AND status = ? AND lease_owner = ?",
+		c.Params("repo"), serial, StatusRunning, owner).Limit(1).Find(&record)
+	if result.Error != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to get testing record")
+	}
+	if result.RowsAffected == 0 {
+		return nil, fiber.NewError(fiber.StatusConflict, "Lease lost")
+	}
+	return &record, nil
+}
+
+// leaseNextTask claims a task for a remote worker, it returns nil if there is none.
+func leaseNextTask(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	owner string,
+) (*TestingTask, error) {
+	for {
+		task, err := claimNextTask(logger, config, db, owner)
+		if err != nil || task == nil {
+			return nil, err
+		}
+		started, err := startTask(logger, config, db, task)
+		if err != nil {
+			task.TestingRecord.Status = StatusError
+			task.TestingRecord.RunEndTime = time.Now().Format(time.RFC3339)
+			if err := saveTestingRecord(db, task.TestingRecord); err != nil && !errors.Is(err, ErrTestingDropped) {
+				logger.Error("Failed to update task status", zap.Error(err))
+			}
+		}
+		if err != nil || !started {
+			releaseLease(logger, db, task.TestingRecord, owner)
+			continue
+		}
+		return task, nil
+	}
+}
+
+func BuildLeaseHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var request leaseRequest
+		if err := c.BodyParser(&request); err != nil || request.Owner == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Lease owner is required",
+			))
+		}
+		seeRemoteWorker(request.Owner, request.Capacity)
+		task, err := leaseNextTask(logger, config, db, request.Owner)
+		if err != nil {
+			logger.Error("Failed to lease task", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to lease task",
+			))
+		}
+		if task == nil {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+		logger.Info("Leased task to worker",
+			zap.String("repository_id", task.RepositoryId),
+			zap.Int("serial", task.Serial),
+			zap.String("lease_owner", request.Owner))
+		// the worker streams its output into it, see BuildWorkerLogHandler
+		openLiveLog(task.TestingRecord)
+		return c.Status(fiber.StatusOK).JSON(router.BuildResponse(workerJob{
+			Testing:              *task.TestingRecord,
+			Repository:           task.Repository,
+			Challenge:            task.Challenge,
+			LeaseTimeoutInSecond: int(leaseTimeout(config).Seconds()),
+		}))
+	}
+}
+
+func BuildWorkerHeartbeatHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		owner := c.Get(LEASE_OWNER_HEADER)
+		seeRemoteWorker(owner, 0)
+		result := db.Model(&schema.Testing{}).
+			Where("repository_id = ? AND serial = ? AND status = ? AND lease_owner = ?",
+				c.Params("repo"), c.Params("serial"), StatusRunning, owner).
+			Update("lease_expire_time", time.Now().Add(leaseTimeout(config)).Format(time.RFC3339))
+		if result.Error != nil {
+			logger.Error("Failed to extend lease", zap.Error(result.Error))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to extend lease",
+			))
+		}
+		if result.RowsAffected == 1 {
+			return c.JSON(router.BuildResponse(heartbeatResponse{}))
+		}
+
+		var record schema.Testing
+		err := db.Where("repository_id = ? AND serial = ? AND lease_owner = ?",
+			c.Params("repo"), c.Params("serial"), owner).First(&record).Error
+		if err == nil && record.Status == StatusCancelled {
+			// the worker stops without posting a result
+			releaseLease(logger, db, &record, owner)
+			closeLiveLog(&record)
+			return c.JSON(router.BuildResponse(heartbeatResponse{Cancelled: true}))
+		}
+		return c.Status(fiber.StatusConflict).JSON(router.BuildError(
+			"Lease lost",
+		))
+	}
+}
+
+func BuildWorkerLogHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		record, ferr := findLeasedTesting(db, c)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+		if broadcaster := findLiveLog(record.RepositoryId, record.Serial); broadcaster != nil {
+			broadcaster.Write(c.Body())
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// archiveFolder packs a folder as a gzipped tar, only the given files of it if any.
+func archiveFolder(folder string, includeFiles []string) ([]byte, error) {
+	tar, err := archive.TarWithOptions(folder, &archive.TarOptions{
+		Compression:  archive.Gzip,
+		IncludeFiles: includeFiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tar.Close()
+	return io.ReadAll(tar)
+}
+
+func BuildWorkerSourceHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		record, ferr := findLeasedTesting(db, c)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+		var repositoryRecord schema.Repository
+		if err := db.Where("repository_id = ?", record.RepositoryId).First(&repositoryRecord).Error; err != nil {
+			logger.Error("Failed to get repository record", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to get repository record",
+			))
+		}
+
+		err := os.MkdirAll(config.Testing.TmpStorageFolder, 0755)
+		var exportPath string
+		if err == nil {
+			exportPath, err = os.MkdirTemp(config.Testing.TmpStorageFolder, "export-")
+		}
+		if err != nil {
+			logger.Error("Failed to create export folder", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to export commit",
+			))
+		}
+		defer os.RemoveAll(exportPath)
+		// the archive is read into memory, the export is removed before the response is sent
+		err = shared.ExportCommit(GetRepositoryPath(config, &repositoryRecord), record.Commit, exportPath)
+		var content []byte
+		if err == nil {
+			content, err = archiveFolder(exportPath, nil)
+		}
+		if err != nil {
+			logger.Error("Failed to export commit", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to export commit",
+			))
+		}
+		c.Set(fiber.HeaderContentType, "application/gzip")
+		return c.Send(content)
+	}
+}
+
+// BuildWorkerChallengeHandler sends the part of the challenge folder a task mounts,
+// see requiredChallengeFiles.
+func BuildWorkerChallengeHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		record, ferr := findLeasedTesting(db, c)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+		task, err := buildTestingTask(logger, config, db, record)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to load task",
+			))
+		}
+		startpoint, _ := getStartPoint(&task.Challenge, task.Repository.Startpoint)
+		if startpoint == nil {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"Startpoint not found",
+			))
+		}
+		var files []string
+		for _, file := range requiredChallengeFiles(task, startpoint) {
+			// never send anything outside of the challenge folder
+			if filepath.IsLocal(file) {
+				files = append(files, file)
+			}
+		}
+		if len(files) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(router.BuildError(
+				"The task mounts nothing of the challenge",
+			))
+		}
+		challengePath := filepath.Join(config.Challenge.StorageFolder, task.Challenge.FolderName)
+		content, err := archiveFolder(challengePath, files)
+		if err != nil {
+			logger.Error("Failed to archive challenge", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to archive challenge",
+			))
+		}
+		c.Set(fiber.HeaderContentType, "application/gzip")
+		return c.Send(content)
+	}
+}
+
+func BuildWorkerResultHandler(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		record, ferr := findLeasedTesting(db, c)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(router.BuildError(ferr.Message))
+		}
+		var request resultRequest
+		if err := c.BodyParser(&request); err != nil || (request.Outcome == nil && request.Error == "") {
+			return c.Status(fiber.StatusBadRequest).JSON(router.BuildError(
+				"Outcome or error is required",
+			))
+		}
+		defer closeLiveLog(record)
+		defer releaseLease(logger, db, record, record.LeaseOwner)
+
+		if request.Error != "" {
+			logger.Error("Worker failed to run task",
+				zap.String("repository_id", record.RepositoryId),
+				zap.Int32("serial", record.Serial),
+				zap.String("error", request.Error))
+			record.Status = StatusError
+			record.RunEndTime = time.Now().Format(time.RFC3339)
+			if err := saveTestingRecord(db, record); err != nil && !errors.Is(err, ErrTestingDropped) {
+				logger.Error("Failed to update task status", zap.Error(err))
+			}
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+
+		task, err := buildTestingTask(logger, config, db, record)
+		if err == nil {
+			err = recordTaskOutcome(logger, db, task, request.Outcome)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(router.BuildError(
+				"Failed to record outcome",
+			))
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func SetupWorkerRouter(
+	logger *zap.Logger,
+	config *jConfig.JudgeConfig,
+	db *gorm.DB,
+	group *fiber.Router,
+) {
+	authorization := buildWorkerAuthorizationMiddleWare(logger, config)
+	(*group).Post("/lease", authorization, BuildLeaseHandler(logger, config, db))
+	(*group).Post("/:repo/:serial/heartbeat", authorization, BuildWorkerHeartbeatHandler(logger, config, db))
+	(*group).Post("/:repo/:serial/log", authorization, BuildWorkerLogHandler(logger, config, db))
+	(*group).Get("/:repo/:serial/source", authorization, BuildWorkerSourceHandler(logger, config, db))
+	(*group).Get("/:repo/:serial/challenge", authorization, BuildWorkerChallengeHandler(logger, config, db))
+	(*group).Post("/:repo/:serial/result", authorization, BuildWorkerResultHandler(logger, config, db))
+}
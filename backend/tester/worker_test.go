@@ -0,0 +1,251 @@
+package tester
+
+import (
+	"context"
+	"errors"
+	"judge/challenge"
+	"judge/jConfig"
+	"judge/schema"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const TEST_CHALLENGE_ATTRIBUTE = `
+[basic]
+Title="hello"
+
+[[startpoints]]
+Name="go"
+Root="start"
+Dockerfile="dockerfile"
+
+[[stages]]
+Name="first"
+[[stages]]
+Name="second"
+`
+
+var testChallengeConfig jConfig.ChallengeConfig
+var testChallengeOnce sync.Once
+
+// testChallenges holds the challenge of the tests, the catalog is loaded once per process
+// so every test shares the same challenge folder.
+func testChallenges(t *testing.T) jConfig.ChallengeConfig {
+	t.Helper()
+	testChallengeOnce.Do(func() {
+		storageFolder, err := os.MkdirTemp("", "judge-challenges-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(storageFolder, "hello", "start"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		attributePath := filepath.Join(storageFolder, "hello", challenge.ATTRIBUTE_FILE_NAME)
+		if err := os.WriteFile(attributePath, []byte(TEST_CHALLENGE_ATTRIBUTE), 0644); err != nil {
+			t.Fatal(err)
+		}
+		testChallengeConfig = jConfig.ChallengeConfig{StorageFolder: storageFolder, ReloadIntervalInSecond: -1}
+		challenge.GetCatalog(zap.NewNop(), &testChallengeConfig)
+	})
+	if _, err := challenge.GetCatalog(zap.NewNop(), &testChallengeConfig).Get("hello"); err != nil {
+		t.Fatal(err)
+	}
+	return testChallengeConfig
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testChallengeConfig.StorageFolder != "" {
+		os.RemoveAll(testChallengeConfig.StorageFolder)
+	}
+	os.Exit(code)
+}
+
+// newTestWorkerServer serves the worker API with a pending testing of a repository at stage 1.
+func newTestWorkerServer(t *testing.T) (*jConfig.JudgeConfig, *gorm.DB, *httptest.Server) {
+	t.Helper()
+	config := &jConfig.JudgeConfig{}
+	config.Challenge = testChallenges(t)
+	config.RepositoryStorage.StorageFolder = t.TempDir()
+	config.Testing.TmpStorageFolder = t.TempDir()
+	config.Testing.RunningTimeoutInMinute = 1
+	config.Testing.PendingQueueTimeoutInMinute = 1
+	config.Testing.LeaseTimeoutInSecond = 1
+	config.Testing.RequeueOrphanedTasks = true
+	config.Testing.WorkerToken = "worker-token"
+
+	db := newTestDB(t)
+	repositoryRecord := schema.Repository{
+		RepositoryId:        "repo",
+		Provider:            "provider",
+		Subject:             "subject",
+		ChallengeFolderName: "hello",
+		Startpoint:          "go",
+		Stage:               1,
+	}
+	db.Create(&repositoryRecord)
+	commit := newTestRepository(t, config, &repositoryRecord)
+	db.Create(&schema.Testing{
+		RepositoryId: "repo",
+		Serial:       1,
+		Stage:        1,
+		Status:       StatusPending,
+		Commit:       commit,
+		CreateTime:   time.Now().Format(time.RFC3339),
+	})
+
+	app := fiber.New()
+	workerRouter := app.Group("/worker")
+	SetupWorkerRouter(zap.NewNop(), config, db, &workerRouter)
+	server := httptest.NewServer(adaptor.FiberApp(app))
+	t.Cleanup(server.Close)
+	return config, db, server
+}
+
+func newTestWorkerClient(server *httptest.Server, owner string) *workerClient {
+	return &workerClient{
+		serverUrl: server.URL,
+		token:     "worker-token",
+		owner:     owner,
+		capacity:  1,
+		http:      server.Client(),
+	}
+}
+
+func newTestWorkerConfig(t *testing.T) *jConfig.JudgeConfig {
+	config := &jConfig.JudgeConfig{}
+	config.Testing.TmpStorageFolder = t.TempDir()
+	config.Testing.RunningTimeoutInMinute = 1
+	return config
+}
+
+func findTesting(t *testing.T, db *gorm.DB) schema.Testing {
+	t.Helper()
+	var record schema.Testing
+	if err := db.Where("repository_id = ? AND serial = ?", "repo", 1).First(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestRemoteWorkerRunsLeasedTask(t *testing.T) {
+	_, db, server := newTestWorkerServer(t)
+	client := newTestWorkerClient(server, "worker")
+	job, err := client.lease(context.Background())
+	if err != nil || job == nil {
+		t.Fatal("no job leased", err)
+	}
+	if record := findTesting(t, db); record.Status != StatusRunning || record.LeaseOwner != "worker" {
+		t.Fatalf("leased testing is %q owned by %q", record.Status, record.LeaseOwner)
+	}
+	if again, err := client.lease(context.Background()); err != nil || again != nil {
+		t.Fatalf("leased %v twice, err = %v", again, err)
+	}
+
+	sandbox := &FakeSandbox{}
+	runJob(zap.NewNop(), newTestWorkerConfig(t), sandbox, client, job)
+
+	record := findTesting(t, db)
+	if record.Status != StatusSuccess || record.LeaseOwner != "" {
+		t.Errorf("testing is %q owned by %q, want %q and released", record.Status, record.LeaseOwner, StatusSuccess)
+	}
+	if runs := len(sandbox.Runs()); runs != 1 {
+		t.Errorf("runs = %d, want 1", runs)
+	}
+	var repositoryRecord schema.Repository
+	db.Where("repository_id = ?", "repo").First(&repositoryRecord)
+	if repositoryRecord.Stage != 2 {
+		t.Errorf("repository stage = %d, want 2", repositoryRecord.Stage)
+	}
+}
+
+func TestRemoteWorkerMissedHeartbeatReclaimsLease(t *testing.T) {
+	config, db, server := newTestWorkerServer(t)
+	client := newTestWorkerClient(server, "worker")
+	job, err := client.lease(context.Background())
+	if err != nil || job == nil {
+		t.Fatal("no job leased", err)
+	}
+	jobPath := "/repo/1"
+	var response heartbeatResponse
+	if _, err := client.post(context.Background(), jobPath+"/heartbeat", struct{}{}, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker stops heartbeating, e.g. it crashed
+	time.Sleep(leaseTimeout(config) + 1100*time.Millisecond)
+	if err := reclaimExpiredLeases(zap.NewNop(), config, db); err != nil {
+		t.Fatal(err)
+	}
+	if record := findTesting(t, db); record.Status != StatusPending || record.LeaseOwner != "" {
+		t.Fatalf("testing is %q owned by %q, want it requeued", record.Status, record.LeaseOwner)
+	}
+	if _, err := client.post(context.Background(), jobPath+"/heartbeat", struct{}{}, &response); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("heartbeat after the reclaim: err = %v, want %v", err, ErrLeaseLost)
+	}
+	result := resultRequest{Outcome: &taskOutcome{Results: []*stageResult{{Stage: 1, Status: StatusSuccess, Score: 1, MaxScore: 1}}}}
+	if _, err := client.post(context.Background(), jobPath+"/result", result, nil); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("result after the reclaim: err = %v, want %v", err, ErrLeaseLost)
+	}
+
+	// another worker picks it up
+	other := newTestWorkerClient(server, "other")
+	job, err = other.lease(context.Background())
+	if err != nil || job == nil {
+		t.Fatal("requeued job not leased", err)
+	}
+	if record := findTesting(t, db); record.LeaseOwner != "other" {
+		t.Errorf("lease owner = %q, want other", record.LeaseOwner)
+	}
+}
+
+func TestRemoteWorkerResultAfterCancelIsDropped(t *testing.T) {
+	_, db, server := newTestWorkerServer(t)
+	client := newTestWorkerClient(server, "worker")
+	job, err := client.lease(context.Background())
+	if err != nil || job == nil {
+		t.Fatal("no job leased", err)
+	}
+	// the user cancels while the stage runs, the run still passes
+	sandbox := &FakeSandbox{RunFunc: func(spec *RunSpec) (*RunResult, error) {
+		if _, err := CancelTesting(zap.NewNop(), db, "repo", 1); err != nil {
+			return nil, err
+		}
+		return &RunResult{}, WriteFakeReport(spec.ReportPath, true, "passed")
+	}}
+	runJob(zap.NewNop(), newTestWorkerConfig(t), sandbox, client, job)
+
+	record := findTesting(t, db)
+	if record.Status != StatusCancelled {
+		t.Errorf("status = %q, want it to stay %q", record.Status, StatusCancelled)
+	}
+	var repositoryRecord schema.Repository
+	db.Where("repository_id = ?", "repo").First(&repositoryRecord)
+	if repositoryRecord.Stage != 1 {
+		t.Errorf("repository advanced to stage %d", repositoryRecord.Stage)
+	}
+	var stages int64
+	db.Model(&schema.TestingStage{}).Count(&stages)
+	if stages != 0 {
+		t.Errorf("recorded %d stages of a cancelled testing", stages)
+	}
+
+	var response heartbeatResponse
+	if _, err := client.post(context.Background(), "/repo/1/heartbeat", struct{}{}, &response); err == nil && !response.Cancelled {
+		t.Error("heartbeat of a cancelled testing did not report the cancel")
+	}
+	if status, err := client.post(context.Background(), "/repo/1/result",
+		resultRequest{Outcome: &taskOutcome{}}, nil); !errors.Is(err, ErrLeaseLost) || status != http.StatusConflict {
+		t.Errorf("late result: status %d, err = %v, want %d", status, err, http.StatusConflict)
+	}
+}